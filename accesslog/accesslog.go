@@ -0,0 +1,137 @@
+// Package accesslog writes one line per handled request to a rotated file,
+// separate from the application log.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"website_proxier/duration"
+)
+
+type Format string
+
+const (
+	FormatJSON     Format = "json"
+	FormatCombined Format = "combined"
+)
+
+type Config struct {
+	Path        string            `json:"path"`
+	Format      Format            `json:"format"`
+	MaxSizeMB   int               `json:"max_size_mb"`  // rotate once the file is bigger
+	RotateEvery duration.Duration `json:"rotate_every"` // rotate once the file is older
+	MaxBackups  int               `json:"max_backups"`  // rotated files to keep
+	MaxAge      duration.Duration `json:"max_age"`      // remove rotated files older than this
+}
+
+type Entry struct {
+	Time        time.Time     `json:"time"`
+	RequestID   string        `json:"request_id"`
+	ClientIP    string        `json:"client_ip"`
+	Host        string        `json:"host"`
+	Site        string        `json:"site"`
+	Method      string        `json:"method"`
+	Path        string        `json:"path"`
+	Proto       string        `json:"proto"`
+	Status      int           `json:"status"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"-"`
+	CacheStatus string        `json:"cache_status"`
+	Proxy       string        `json:"proxy,omitempty"`
+	Retries     int           `json:"retries"`
+	Referer     string        `json:"referer,omitempty"`
+	UserAgent   string        `json:"user_agent,omitempty"`
+}
+
+type Logger struct {
+	format Format
+	out    io.WriteCloser
+}
+
+func New(cfg Config) (*Logger, error) {
+	switch cfg.Format {
+	case "":
+		cfg.Format = FormatJSON
+	case FormatJSON, FormatCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", cfg.Format)
+	}
+	out, err := openRotatingFile(cfg.Path, int64(cfg.MaxSizeMB)<<20, cfg.RotateEvery.Duration, cfg.MaxBackups, cfg.MaxAge.Duration)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{
+		format: cfg.Format,
+		out:    out,
+	}, nil
+}
+
+func (l *Logger) Log(e Entry) error {
+	var line []byte
+	if l.format == FormatCombined {
+		line = formatCombined(e)
+	} else {
+		var err error
+		line, err = formatJSON(e)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := l.out.Write(line)
+	return err
+}
+
+func (l *Logger) Close() error {
+	return l.out.Close()
+}
+
+func formatJSON(e Entry) ([]byte, error) {
+	type jsonEntry struct {
+		Entry
+		DurationMs float64 `json:"duration_ms"`
+	}
+	line, err := json.Marshal(jsonEntry{
+		Entry:      e,
+		DurationMs: float64(e.Duration.Microseconds()) / 1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatCombined writes the Combined Log Format, followed by the mirror host,
+// site name, duration in milliseconds, cache status, proxy, retry count and
+// request id.
+func formatCombined(e Entry) []byte {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Appendf(nil, "%s - - [%s] %s %d %s %s %s %s %s %.3f %s %s %d %s\n",
+		orDash(e.ClientIP),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.Path+" "+e.Proto),
+		e.Status,
+		size,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		strconv.Quote(e.Host),
+		strconv.Quote(orDash(e.Site)),
+		float64(e.Duration.Microseconds())/1000,
+		e.CacheStatus,
+		strconv.Quote(orDash(e.Proxy)),
+		e.Retries,
+		orDash(e.RequestID),
+	)
+}
@@ -0,0 +1,98 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "access.log")
+	f, err := openRotatingFile(name, 100, 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for range 8 {
+		if _, err := f.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, _ := filepath.Glob(name + ".*")
+	if len(backups) != 2 {
+		t.Errorf("expected 2 backups to be kept, got %v", backups)
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(line)) {
+		t.Errorf("expected the current file to hold one line, got %d bytes", stat.Size())
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(name, 100, 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rename = func(string, string) error { return os.ErrPermission }
+	defer func() { rename = os.Rename }()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := range 3 {
+		_, err := f.Write(line)
+		if i == 1 && err == nil {
+			t.Error("expected the failed rotation to be reported")
+		}
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 3*len(line) {
+		t.Errorf("expected the lines to be written to the current file, got %d bytes", len(content))
+	}
+
+	rename = os.Rename
+	f.retryRotateAt = time.Time{}
+	if _, err := f.Write(line); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := filepath.Glob(name + ".*"); len(backups) != 1 {
+		t.Errorf("expected the retried rotation to leave a backup, got %v", backups)
+	}
+}
+
+func TestCombinedFormat(t *testing.T) {
+	line := string(formatCombined(Entry{
+		Time:        time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ClientIP:    "203.0.113.7",
+		Host:        "mirror.example",
+		Site:        "example",
+		Method:      "GET",
+		Path:        "/index.html?a=1",
+		Proto:       "HTTP/1.1",
+		Status:      200,
+		Bytes:       512,
+		Duration:    time.Millisecond * 1500,
+		CacheStatus: "miss",
+		Proxy:       "http://10.0.0.1:8080",
+		Retries:     1,
+		UserAgent:   "curl/8.0",
+		RequestID:   "abc123",
+	}))
+	expected := `203.0.113.7 - - [01/Mar/2024:12:30:00 +0000] "GET /index.html?a=1 HTTP/1.1" 200 512 "-" "curl/8.0" "mirror.example" "example" 1500.000 miss "http://10.0.0.1:8080" 1 abc123` + "\n"
+	if line != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, line)
+	}
+}
@@ -0,0 +1,156 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405"
+
+// rotateRetry is how long a failed rotation waits before it is tried again,
+// writes go to the current file meanwhile.
+const rotateRetry = time.Minute
+
+// rename is os.Rename, replaced in tests.
+var rename = os.Rename
+
+// rotatingFile is a file that is rotated once it grows over maxSize or gets
+// older than rotateEvery. Rotated files are renamed to name.<timestamp> and
+// removed once there are more than maxBackups of them or they are older than
+// maxAge. Zero values disable the respective limit.
+type rotatingFile struct {
+	name        string
+	maxSize     int64
+	rotateEvery time.Duration
+	maxBackups  int
+	maxAge      time.Duration
+
+	mu            sync.Mutex
+	file          *os.File
+	size          int64
+	openedAt      time.Time
+	retryRotateAt time.Time // after a failed rotation
+}
+
+func openRotatingFile(name string, maxSize int64, rotateEvery time.Duration, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	f := &rotatingFile{
+		name:        name,
+		maxSize:     maxSize,
+		rotateEvery: rotateEvery,
+		maxBackups:  maxBackups,
+		maxAge:      maxAge,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.name), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var rotateErr error
+	if f.shouldRotate(int64(len(b))) {
+		if rotateErr = f.rotate(); rotateErr != nil {
+			f.retryRotateAt = time.Now().Add(rotateRetry)
+			rotateErr = fmt.Errorf("error rotating %s: %w", f.name, rotateErr)
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, rotateErr
+}
+
+func (f *rotatingFile) shouldRotate(next int64) bool {
+	if f.size == 0 || time.Now().Before(f.retryRotateAt) {
+		return false
+	}
+	if f.maxSize > 0 && f.size+next > f.maxSize {
+		return true
+	}
+	return f.rotateEvery > 0 && time.Since(f.openedAt) >= f.rotateEvery
+}
+
+// rotate renames the file and opens a new one. The current file stays open
+// until the new one is, so on any error writes keep going to it.
+func (f *rotatingFile) rotate() error {
+	backup := f.name + "." + time.Now().Format(backupTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s.%d", f.name, time.Now().Format(backupTimeFormat), i)
+	}
+	if err := rename(f.name, backup); err != nil {
+		return err
+	}
+	previous := f.file
+	if err := f.open(); err != nil {
+		// back to the name it had, so the next rotation starts over
+		_ = rename(backup, f.name)
+		return err
+	}
+	_ = previous.Close()
+	f.removeOldBackups()
+	return nil
+}
+
+func (f *rotatingFile) removeOldBackups() {
+	backups, err := filepath.Glob(f.name + ".*")
+	if err != nil {
+		return
+	}
+	backups = slices.DeleteFunc(backups, func(name string) bool {
+		_, err := time.Parse(backupTimeFormat, strings.SplitN(strings.TrimPrefix(name, f.name+"."), ".", 2)[0])
+		return err != nil
+	})
+	// the timestamp suffix sorts chronologically, newest first after reversing
+	slices.Sort(backups)
+	slices.Reverse(backups)
+
+	for i, backup := range backups {
+		expired := false
+		if f.maxAge > 0 {
+			if stat, err := os.Stat(backup); err == nil && time.Since(stat.ModTime()) > f.maxAge {
+				expired = true
+			}
+		}
+		if expired || f.maxBackups > 0 && i >= f.maxBackups {
+			_ = os.Remove(backup)
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -34,3 +34,8 @@ func (b BrotliEncoderDecoder) Decode(data []byte) ([]byte, error) {
 	}
 	return decoded, nil
 }
+
+// NewReader decompresses Brotli data from r as it is read.
+func (b BrotliEncoderDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(r)), nil
+}
@@ -2,6 +2,7 @@ package encoding
 
 import (
 	"fmt"
+	"io"
 	"strings"
 )
 
@@ -43,6 +44,25 @@ func Decode(data []byte, encoding string) ([]byte, error) {
 	return decoder.Decode(data)
 }
 
+func NewDecodeReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	var decoder StreamDecoder
+	switch encoding {
+	case "gzip":
+		decoder = GzipEncoderDecoder{}
+	case "brotli", "br":
+		decoder = BrotliEncoderDecoder{}
+	case "deflate":
+		decoder = DeflateEncoderDecoder{}
+	case "zstd":
+		decoder = ZstdEncoderDecoder{}
+	case "plain", "":
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown encoding: %s", encoding)
+	}
+	return decoder.NewReader(r)
+}
+
 func EncodeWithSomething(data []byte, acceptEncoding string) ([]byte, string, error) {
 	acceptEncodingChunks := strings.Split(acceptEncoding, ",")
 	for _, encoding := range acceptEncodingChunks {
@@ -1,5 +1,7 @@
 package encoding
 
+import "io"
+
 type Encoder interface {
 	Encode([]byte) ([]byte, error)
 }
@@ -8,6 +10,12 @@ type Decoder interface {
 	Decode([]byte) ([]byte, error)
 }
 
+// StreamDecoder decodes data while it is read, for bodies that cannot be
+// buffered whole.
+type StreamDecoder interface {
+	NewReader(io.Reader) (io.ReadCloser, error)
+}
+
 type EncoderAndDecoder interface {
 	Encoder
 	Decoder
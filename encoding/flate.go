@@ -37,3 +37,8 @@ func (d DeflateEncoderDecoder) Decode(data []byte) ([]byte, error) {
 	}
 	return decoded, nil
 }
+
+// NewReader decompresses deflate data from r as it is read.
+func (d DeflateEncoderDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
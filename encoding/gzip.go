@@ -38,3 +38,8 @@ func (g GzipEncoderDecoder) Decode(data []byte) ([]byte, error) {
 	}
 	return decoded, nil
 }
+
+// NewReader decompresses gzip data from r as it is read.
+func (g GzipEncoderDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
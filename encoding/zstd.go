@@ -1,6 +1,8 @@
 package encoding
 
 import (
+	"io"
+
 	"github.com/klauspost/compress/zstd"
 )
 
@@ -33,3 +35,12 @@ func (z ZstdEncoderDecoder) Decode(data []byte) ([]byte, error) {
 	}
 	return decoded, nil
 }
+
+// NewReader decompresses Zstandard data from r as it is read.
+func (z ZstdEncoderDecoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
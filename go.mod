@@ -1,10 +1,12 @@
 module website_proxier
 
-go 1.23.4
+go 1.24.0
 
 require (
-	github.com/andybalholm/brotli v1.1.1 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	github.com/andybalholm/brotli v1.1.1
+	github.com/klauspost/compress v1.17.11
+	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.45.0
 )
+
+require golang.org/x/sys v0.38.0 // indirect
@@ -0,0 +1,243 @@
+// Package ipfilter allows or denies clients by their IP, with CIDR lists from
+// the config and from list files that are reloaded when they change.
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	Allow      []string `json:"allow"`       // CIDRs or addresses, everyone not denied is allowed when no allow list is set
+	AllowFiles []string `json:"allow_files"` // one CIDR or address per line, # starts a comment
+	Deny       []string `json:"deny"`        // deny wins over allow
+	DenyFiles  []string `json:"deny_files"`
+	Response   Response `json:"response"` // sent to denied clients
+}
+
+// Response is what a denied client gets.
+type Response struct {
+	Status      int    `json:"status"` // 403 when zero
+	Body        string `json:"body"`
+	ContentType string `json:"content_type"` // text/plain when empty
+	Location    string `json:"location"`     // for redirects
+}
+
+func (r *Response) setDefaults() {
+	if r.Status == 0 {
+		r.Status = http.StatusForbidden
+	}
+	if r.Body == "" && r.Location == "" {
+		r.Body = http.StatusText(r.Status)
+	}
+	if r.ContentType == "" {
+		r.ContentType = "text/plain; charset=utf-8"
+	}
+}
+
+// ParsePrefixes parses CIDRs, a bare address is a single host.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", cidr, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Contains reports whether any of the prefixes contains addr.
+func Contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func readListFile(name string) ([]netip.Prefix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cidrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	prefixes, err := ParsePrefixes(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return prefixes, nil
+}
+
+func modTime(name string) time.Time {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// Filter decides which clients get through. A nil filter allows everyone.
+type Filter struct {
+	cfg                   Config
+	allow, deny           []netip.Prefix
+	allowFiles, denyFiles []string
+
+	mu          sync.RWMutex
+	hasAllow    bool
+	allowed     []netip.Prefix // allow and the allow files
+	denied      []netip.Prefix
+	fileModTime map[string]time.Time
+}
+
+// New builds a filter, relative list file names are resolved against dir.
+func New(cfg Config, dir string) (*Filter, error) {
+	cfg.Response.setDefaults()
+	f := &Filter{cfg: cfg, fileModTime: make(map[string]time.Time)}
+
+	var err error
+	if f.allow, err = ParsePrefixes(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("allow list: %w", err)
+	}
+	if f.deny, err = ParsePrefixes(cfg.Deny); err != nil {
+		return nil, fmt.Errorf("deny list: %w", err)
+	}
+	for _, name := range cfg.AllowFiles {
+		f.allowFiles = append(f.allowFiles, resolve(dir, name))
+	}
+	for _, name := range cfg.DenyFiles {
+		f.denyFiles = append(f.denyFiles, resolve(dir, name))
+	}
+	f.hasAllow = len(cfg.Allow) > 0 || len(cfg.AllowFiles) > 0
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func resolve(dir, name string) string {
+	if dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// load reads the list files and swaps in the new lists. On error the old ones
+// stay.
+func (f *Filter) load() error {
+	modTimes := make(map[string]time.Time)
+	allowed := append([]netip.Prefix(nil), f.allow...)
+	for _, name := range f.allowFiles {
+		modTimes[name] = modTime(name)
+		prefixes, err := readListFile(name)
+		if err != nil {
+			return err
+		}
+		allowed = append(allowed, prefixes...)
+	}
+	denied := append([]netip.Prefix(nil), f.deny...)
+	for _, name := range f.denyFiles {
+		modTimes[name] = modTime(name)
+		prefixes, err := readListFile(name)
+		if err != nil {
+			return err
+		}
+		denied = append(denied, prefixes...)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allowed, f.denied, f.fileModTime = allowed, denied, modTimes
+	return nil
+}
+
+// Reload reads the list files again when any of them changed on disk.
+func (f *Filter) Reload() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	changed := false
+	for name, loadedModTime := range f.fileModTime {
+		changed = changed || !modTime(name).Equal(loadedModTime)
+	}
+	f.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	if err := f.load(); err != nil {
+		// keep the old lists until the files change again
+		f.mu.Lock()
+		for name := range f.fileModTime {
+			f.fileModTime[name] = modTime(name)
+		}
+		f.mu.Unlock()
+		return err
+	}
+	logrus.WithField("files", len(f.allowFiles)+len(f.denyFiles)).Info("IP lists reloaded")
+	return nil
+}
+
+// Allows reports whether the client may pass. Clients without a valid address
+// only pass when there is no allow list.
+func (f *Filter) Allows(addr netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if !addr.IsValid() {
+		return !f.hasAllow
+	}
+	if Contains(f.denied, addr) {
+		return false
+	}
+	return !f.hasAllow || Contains(f.allowed, addr)
+}
+
+// Deny sends the configured response to a denied client.
+func (f *Filter) Deny(w http.ResponseWriter) {
+	response := f.cfg.Response
+	if response.Location != "" {
+		w.Header().Set("Location", response.Location)
+	}
+	w.Header().Set("Content-Type", response.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(response.Status)
+	_, _ = w.Write([]byte(response.Body))
+}
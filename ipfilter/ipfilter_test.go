@@ -0,0 +1,52 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	dir := t.TempDir()
+	denyFile := filepath.Join(dir, "deny.txt")
+	if err := os.WriteFile(denyFile, []byte("# abusive\n10.1.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := New(Config{Allow: []string{"10.0.0.0/8", "2001:db8::1"}, DenyFiles: []string{"deny.txt"}}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(addr string, want bool) {
+		t.Helper()
+		if got := f.Allows(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: got %v, want %v", addr, got, want)
+		}
+	}
+	check("10.2.3.4", true)
+	check("2001:db8::1", true)
+	check("10.1.2.3", false)
+	check("192.0.2.1", false)
+	if f.Allows(netip.Addr{}) {
+		t.Error("unknown address allowed with an allow list")
+	}
+
+	if err := os.WriteFile(denyFile, []byte("10.2.0.0/16\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(denyFile, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("10.1.2.3", true)
+	check("10.2.3.4", false)
+
+	var none *Filter
+	if !none.Allows(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("nil filter denied")
+	}
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Requests.", "site", "status")
+	latency := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "site")
+	registry.NewGaugeFunc("entries", "Entries.", []string{"site"}, func(emit func(float64, ...string)) {
+		emit(3, `a"b`)
+	})
+
+	requests.Inc("b", "200")
+	requests.Add(2, "a", "200")
+	latency.Observe(0.05, "a")
+	latency.Observe(0.5, "a")
+	latency.Observe(5, "a")
+
+	var out strings.Builder
+	registry.Write(&out)
+	expected := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{site="a",status="200"} 2
+requests_total{site="b",status="200"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{site="a",le="0.1"} 1
+latency_seconds_bucket{site="a",le="1"} 2
+latency_seconds_bucket{site="a",le="+Inf"} 3
+latency_seconds_sum{site="a"} 5.55
+latency_seconds_count{site="a"} 3
+# HELP entries Entries.
+# TYPE entries gauge
+entries{site="a\"b"} 3
+`
+	if out.String() != expected {
+		t.Errorf("unexpected exposition:\n%s", out.String())
+	}
+}
@@ -0,0 +1,115 @@
+package proxy_pool
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultGroup holds the proxies from proxies.txt, it is used by sites that
+	// don't choose a group
+	DefaultGroup = "default"
+	// DirectGroup always resolves to the direct connection
+	DirectGroup = "direct"
+)
+
+type GroupConfig struct {
+	Proxies []ProxyEntry `json:"proxies"`
+}
+
+// ProxyEntry is a proxy in the structured config file.
+type ProxyEntry struct {
+	Address  string            `json:"address"`  // host:port
+	Protocol string            `json:"protocol"` // http, https, socks5 or socks5h, http by default
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	Label    string            `json:"label"`
+	Weight   int               `json:"weight"` // 1 by default
+	Headers  map[string]string `json:"headers"`
+}
+
+func (e ProxyEntry) spec() (ProxySpec, error) {
+	protocol := e.Protocol
+	if protocol == "" {
+		protocol = "http"
+	}
+	proxyUrl := &url.URL{
+		Scheme: protocol,
+		Host:   e.Address,
+	}
+	if e.Username != "" {
+		proxyUrl.User = url.UserPassword(e.Username, e.Password)
+	}
+	if err := validateProxyUrl(proxyUrl); err != nil {
+		return ProxySpec{}, err
+	}
+	if e.Weight < 0 {
+		return ProxySpec{}, fmt.Errorf("negative weight %d", e.Weight)
+	}
+
+	spec := ProxySpec{
+		URL:    proxyUrl,
+		Label:  e.Label,
+		Weight: e.Weight,
+	}
+	if len(e.Headers) > 0 {
+		if strings.HasPrefix(protocol, "socks5") {
+			return ProxySpec{}, fmt.Errorf("connect headers are not supported for socks5 proxies")
+		}
+		spec.ConnectHeaders = make(http.Header, len(e.Headers))
+		for k, v := range e.Headers {
+			spec.ConnectHeaders.Set(k, v)
+		}
+	}
+	return spec, nil
+}
+
+// group is a named set of proxies, selected with smooth weighted round-robin
+// among the healthy ones.
+type group struct {
+	name    string
+	proxies []*Proxy
+	weights []int
+
+	mu      sync.Mutex
+	current []int
+}
+
+func newGroup(name string) *group {
+	return &group{name: name}
+}
+
+func (g *group) add(proxy *Proxy, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	g.proxies = append(g.proxies, proxy)
+	g.weights = append(g.weights, weight)
+	g.current = append(g.current, 0)
+}
+
+func (g *group) next() *Proxy {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	best := -1
+	total := 0
+	for i, proxy := range g.proxies {
+		if !proxy.Healthy() {
+			continue
+		}
+		g.current[i] += g.weights[i]
+		total += g.weights[i]
+		if best == -1 || g.current[i] > g.current[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	g.current[best] -= total
+	return g.proxies[best]
+}
@@ -0,0 +1,98 @@
+package proxy_pool
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"website_proxier/duration"
+
+	"github.com/sirupsen/logrus"
+)
+
+type HealthConfig struct {
+	CheckURL         string            `json:"check_url"` // active checks are disabled when empty
+	CheckInterval    duration.Duration `json:"check_interval"`
+	CheckTimeout     duration.Duration `json:"check_timeout"`
+	FailureThreshold int               `json:"failure_threshold"` // consecutive failures before a proxy is ejected
+	BaseEjection     duration.Duration `json:"base_ejection"`     // doubled on every consecutive ejection
+	MaxEjection      duration.Duration `json:"max_ejection"`
+	FallbackDirect   bool              `json:"fallback_direct"` // go direct when every proxy is ejected
+}
+
+func (c *HealthConfig) setDefaults() {
+	c.CheckInterval.Duration = c.CheckInterval.Or(time.Second * 30)
+	c.CheckTimeout.Duration = c.CheckTimeout.Or(time.Second * 10)
+	c.BaseEjection.Duration = c.BaseEjection.Or(time.Second * 30)
+	c.MaxEjection.Duration = c.MaxEjection.Or(time.Minute * 10)
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 3
+	}
+}
+
+func checkProxy(proxy *Proxy, cfg HealthConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CheckTimeout.Duration)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.CheckURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := proxy.Client(ProtocolAuto).Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Pool) runHealthChecks() {
+	cfg := p.HealthConfig()
+
+	var wg sync.WaitGroup
+	for _, proxy := range p.GetAllProxies() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := checkProxy(proxy, cfg)
+
+			proxy.mu.Lock()
+			proxy.lastCheckedAt = time.Now()
+			proxy.mu.Unlock()
+
+			if err != nil {
+				logrus.WithError(err).WithField("proxy", proxy.Name()).Warn("Proxy health check failed")
+				proxy.ReportFailure(err)
+				return
+			}
+			proxy.ReportSuccess()
+		}()
+	}
+	wg.Wait()
+}
+
+// StartHealthChecks runs active health checks in the background until stop is
+// closed. Checks are skipped while no check URL is configured, the config is
+// re-read on every round so that reloads take effect.
+func (p *Pool) StartHealthChecks(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(p.HealthConfig().CheckInterval.Duration)
+		defer ticker.Stop()
+		for {
+			cfg := p.HealthConfig()
+			if cfg.CheckURL != "" {
+				p.runHealthChecks()
+			}
+			ticker.Reset(cfg.CheckInterval.Duration)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,117 @@
+package proxy_pool
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var supportedSchemes = []string{"http", "https", "socks5", "socks5h"}
+
+// ProxySpec describes a proxy as read from the proxy list.
+type ProxySpec struct {
+	URL *url.URL
+	// ConnectHeaders are sent to http(s) proxies on CONNECT
+	ConnectHeaders http.Header
+	Label          string
+	Weight         int
+}
+
+// Key identifies the proxy, two specs with the same key build identical clients.
+// The weight is not part of the key, it belongs to the group membership.
+func (s ProxySpec) Key() string {
+	key := s.Label + " " + s.URL.String()
+	for _, name := range slices.Sorted(maps.Keys(s.ConnectHeaders)) {
+		key += " " + name + ":" + strings.Join(s.ConnectHeaders[name], ",")
+	}
+	return key
+}
+
+// parseProxyLine parses a line of the form
+//
+//	scheme://[user:password@]host:port [Header-Name:value ...]
+//
+// where scheme is one of http, https, socks5 or socks5h. Header tokens are
+// only allowed for http(s) proxies.
+func parseProxyLine(line string) (ProxySpec, error) {
+	fields := strings.Fields(line)
+	spec := ProxySpec{}
+
+	proxyUrl, err := url.Parse(fields[0])
+	if err != nil {
+		// url.Error repeats the whole url, credentials included
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return spec, urlErr.Err
+		}
+		return spec, err
+	}
+	if err := validateProxyUrl(proxyUrl); err != nil {
+		return spec, err
+	}
+	spec.URL = proxyUrl
+
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, ":")
+		if !ok || name == "" {
+			return spec, fmt.Errorf("invalid header %q, expected Name:value", field)
+		}
+		if spec.ConnectHeaders == nil {
+			spec.ConnectHeaders = make(http.Header)
+		}
+		spec.ConnectHeaders.Add(name, value)
+	}
+	if len(spec.ConnectHeaders) > 0 && strings.HasPrefix(proxyUrl.Scheme, "socks5") {
+		return spec, errors.New("connect headers are not supported for socks5 proxies")
+	}
+
+	return spec, nil
+}
+
+func validateProxyUrl(proxyUrl *url.URL) error {
+	if !slices.Contains(supportedSchemes, proxyUrl.Scheme) {
+		return fmt.Errorf("unsupported scheme %q", proxyUrl.Scheme)
+	}
+	if proxyUrl.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	port, err := strconv.Atoi(proxyUrl.Port())
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", proxyUrl.Port())
+	}
+	if proxyUrl.Path != "" && proxyUrl.Path != "/" || proxyUrl.RawQuery != "" {
+		return errors.New("proxy url must not have a path or query")
+	}
+	return nil
+}
+
+// readProxies reads a proxy list, one proxy per line. Empty lines and lines
+// starting with # are skipped. Invalid lines are left out of the result and
+// reported together in parseErr, with their line numbers. err is only set
+// when reading fails.
+func readProxies(r io.Reader) (proxies []ProxySpec, parseErr error, err error) {
+	scanner := bufio.NewScanner(r)
+	var errs []error
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		spec, err := parseProxyLine(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", lineNum, err))
+			continue
+		}
+		proxies = append(proxies, spec)
+	}
+	return proxies, errors.Join(errs...), scanner.Err()
+}
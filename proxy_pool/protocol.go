@@ -0,0 +1,47 @@
+package proxy_pool
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Protocol selects the HTTP version spoken to the upstream, through the proxy.
+type Protocol string
+
+const (
+	// ProtocolAuto negotiates HTTP/2 over TLS with ALPN and falls back to HTTP/1.1.
+	ProtocolAuto Protocol = "auto"
+	// ProtocolHTTP1 always uses HTTP/1.1.
+	ProtocolHTTP1 Protocol = "http1"
+	// ProtocolHTTP2 always uses HTTP/2, with prior knowledge (h2c) for plain
+	// http upstreams.
+	ProtocolHTTP2 Protocol = "http2"
+)
+
+// ParseProtocol parses a protocol name, empty means auto.
+func ParseProtocol(name string) (Protocol, error) {
+	switch protocol := Protocol(name); protocol {
+	case "":
+		return ProtocolAuto, nil
+	case ProtocolAuto, ProtocolHTTP1, ProtocolHTTP2:
+		return protocol, nil
+	default:
+		return "", fmt.Errorf("unknown upstream protocol %q", name)
+	}
+}
+
+func (p Protocol) protocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	switch p {
+	case ProtocolHTTP1:
+		protocols.SetHTTP1(true)
+	case ProtocolHTTP2:
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		// a hand built transport only tries HTTP/2 when asked to
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	}
+	return protocols
+}
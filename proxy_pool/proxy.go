@@ -0,0 +1,284 @@
+package proxy_pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+	"website_proxier/redact"
+
+	"github.com/sirupsen/logrus"
+)
+
+type State string
+
+const (
+	StateHealthy  State = "healthy"
+	StateSuspect  State = "suspect"
+	StateEjected  State = "ejected"
+	StateDraining State = "draining"
+)
+
+// Proxy is a single upstream proxy (or the direct connection, when URL is nil)
+// together with its http client and health bookkeeping.
+type Proxy struct {
+	URL  *url.URL
+	Spec ProxySpec
+
+	clients  map[Protocol]*http.Client
+	pool     *Pool
+	inFlight atomic.Int64
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	ejections           int
+	ejectedUntil        time.Time
+	lastCheckedAt       time.Time
+	lastError           string
+	successes           uint64
+	failures            uint64
+}
+
+type ProxyStatus struct {
+	Proxy               string    `json:"proxy"`
+	Label               string    `json:"label,omitempty"`
+	Groups              []string  `json:"groups,omitempty"`
+	State               State     `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Ejections           int       `json:"ejections"`
+	EjectedUntil        time.Time `json:"ejected_until,omitempty"`
+	LastCheckedAt       time.Time `json:"last_checked_at,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	Successes           uint64    `json:"successes"`
+	Failures            uint64    `json:"failures"`
+	InFlight            int64     `json:"in_flight"`
+}
+
+func newProxy(pool *Pool, spec ProxySpec) *Proxy {
+	return &Proxy{
+		URL:  spec.URL,
+		Spec: spec,
+		clients: map[Protocol]*http.Client{
+			ProtocolAuto:  newHttpClient(spec, pool.transport, ProtocolAuto),
+			ProtocolHTTP1: newHttpClient(spec, pool.transport, ProtocolHTTP1),
+			ProtocolHTTP2: newHttpClient(spec, pool.transport, ProtocolHTTP2),
+		},
+		pool: pool,
+	}
+}
+
+// Client returns the http client negotiating the given protocol, unknown
+// protocols get the auto client.
+func (p *Proxy) Client(protocol Protocol) *http.Client {
+	if client, ok := p.clients[protocol]; ok {
+		return client
+	}
+	return p.clients[ProtocolAuto]
+}
+
+// CloseIdleConnections closes the idle connections of every client.
+func (p *Proxy) CloseIdleConnections() {
+	for _, client := range p.clients {
+		client.CloseIdleConnections()
+	}
+}
+
+// Name returns the proxy URL without credentials, suitable for logs.
+func (p *Proxy) Name() string {
+	if p.URL == nil {
+		return "direct"
+	}
+	return p.URL.Redacted()
+}
+
+// Do sends the request through the proxy with the given protocol. The request
+// counts as in flight until the response body is closed.
+func (p *Proxy) Do(req *http.Request, protocol Protocol) (*http.Response, error) {
+	// a timer instead of a client timeout, streams have to be able to lift it.
+	// It bounds the request, reading the body included, unless the response
+	// is kept open with KeepOpen.
+	requestTimeout := p.pool.transport.RequestTimeout.Duration
+	ctx, cancel := context.WithCancel(req.Context())
+	timeout := time.AfterFunc(requestTimeout, cancel)
+
+	p.inFlight.Add(1)
+	resp, err := p.Client(protocol).Do(req.WithContext(ctx))
+	if err != nil {
+		p.inFlight.Add(-1)
+		if !timeout.Stop() {
+			err = fmt.Errorf("%w after %s: %w", context.DeadlineExceeded, requestTimeout, err)
+		}
+		cancel()
+		return nil, err
+	}
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, proxy: p, timeout: timeout, cancel: cancel}
+	return resp, nil
+}
+
+// KeepOpen lifts the request timeout from a response returned by Do, for
+// streams that stay open for as long as the upstream sends data.
+func KeepOpen(resp *http.Response) {
+	if body, ok := resp.Body.(*inFlightBody); ok && body.timeout != nil {
+		body.timeout.Stop()
+	}
+}
+
+// Upgrade sends an upgrade request through the proxy over HTTP/1.1. When the
+// upstream switches protocols the connection is returned as well, it counts as
+// in flight until closed. Any other response is returned like Do would.
+func (p *Proxy) Upgrade(req *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	p.inFlight.Add(1)
+	// the client timeout would cut the connection, go to the transport directly
+	resp, err := p.Client(ProtocolHTTP1).Transport.RoundTrip(req)
+	if err != nil {
+		p.inFlight.Add(-1)
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &inFlightBody{ReadCloser: resp.Body, proxy: p}
+		return resp, nil, nil
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = resp.Body.Close()
+		p.inFlight.Add(-1)
+		return nil, nil, errors.New("upgraded connection is not writable")
+	}
+	return resp, &inFlightConn{ReadWriteCloser: conn, proxy: p}, nil
+}
+
+type inFlightBody struct {
+	io.ReadCloser
+	proxy   *Proxy
+	timeout *time.Timer
+	cancel  context.CancelFunc
+	closed  atomic.Bool
+}
+
+func (b *inFlightBody) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		b.proxy.inFlight.Add(-1)
+	}
+	err := b.ReadCloser.Close()
+	if b.timeout != nil {
+		b.timeout.Stop()
+		b.cancel()
+	}
+	return err
+}
+
+type inFlightConn struct {
+	io.ReadWriteCloser
+	proxy  *Proxy
+	closed atomic.Bool
+}
+
+func (c *inFlightConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.proxy.inFlight.Add(-1)
+	}
+	return c.ReadWriteCloser.Close()
+}
+
+func (p *Proxy) IsDirect() bool {
+	return p.URL == nil
+}
+
+func (p *Proxy) Healthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !time.Now().Before(p.ejectedUntil)
+}
+
+func (p *Proxy) ReportSuccess() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.successes++
+	p.consecutiveFailures = 0
+	// only forget previous ejections once the back-off has passed, otherwise an
+	// active check racing with an ejection would re-admit the proxy immediately
+	if !time.Now().Before(p.ejectedUntil) {
+		p.ejections = 0
+	}
+}
+
+// ReportFailure records a failed request through the proxy and ejects it once
+// the failure threshold is reached. A proxy that was ejected before is ejected
+// again on its first failure after re-admission, with a doubled back-off.
+func (p *Proxy) ReportFailure(err error) {
+	cfg := p.pool.HealthConfig()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures++
+	p.consecutiveFailures++
+	if err != nil {
+		p.lastError = redact.String(err.Error())
+	}
+	if p.URL == nil || time.Now().Before(p.ejectedUntil) {
+		return
+	}
+	if p.consecutiveFailures < cfg.FailureThreshold && p.ejections == 0 {
+		return
+	}
+
+	backoff := cfg.BaseEjection.Duration << p.ejections
+	if backoff <= 0 || backoff > cfg.MaxEjection.Duration {
+		backoff = cfg.MaxEjection.Duration
+	}
+	p.ejections++
+	p.ejectedUntil = time.Now().Add(backoff)
+	p.consecutiveFailures = 0
+	logrus.WithField("proxy", p.Name()).WithField("ejections", p.ejections).WithField("backoff", backoff).Warn("Proxy ejected")
+}
+
+func (p *Proxy) Status() ProxyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := ProxyStatus{
+		Proxy:               p.Name(),
+		Label:               p.Spec.Label,
+		State:               StateHealthy,
+		ConsecutiveFailures: p.consecutiveFailures,
+		Ejections:           p.ejections,
+		LastCheckedAt:       p.lastCheckedAt,
+		LastError:           p.lastError,
+		Successes:           p.successes,
+		Failures:            p.failures,
+		InFlight:            p.inFlight.Load(),
+	}
+	if time.Now().Before(p.ejectedUntil) {
+		status.State = StateEjected
+		status.EjectedUntil = p.ejectedUntil
+	} else if p.consecutiveFailures > 0 || p.ejections > 0 {
+		status.State = StateSuspect
+	}
+	return status
+}
+
+func newHttpClient(spec ProxySpec, cfg TransportConfig, protocol Protocol) *http.Client {
+	transport := &http.Transport{
+		MaxIdleConns:          cfg.MaxIdleConns,
+		DisableCompression:    false,
+		IdleConnTimeout:       cfg.IdleConnTimeout.Duration,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout.Duration,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout.Duration,
+		Protocols:             protocol.protocols(),
+	}
+	if spec.URL != nil {
+		// net/http dials socks5 and socks5h proxies itself, credentials included
+		transport.Proxy = http.ProxyURL(spec.URL)
+		transport.ProxyConnectHeader = spec.ConnectHeaders
+	} else {
+		transport.ResponseHeaderTimeout = cfg.DirectResponseHeaderTimeout.Duration
+	}
+
+	return &http.Client{
+		Transport: transport,
+	}
+}
@@ -1,50 +1,176 @@
 package proxy_pool
 
 import (
-	"bufio"
-	"os"
-	"sync/atomic"
+	"maps"
+	"slices"
+	"sync"
 )
 
-var index = atomic.Int32{}
-var availableProxies []string
+type Config struct {
+	Health HealthConfig           `json:"health"`
+	Groups map[string]GroupConfig `json:"groups"`
+}
+
+type Pool struct {
+	mu        sync.RWMutex
+	proxies   []*Proxy // every proxy once, even if it is in several groups
+	groups    map[string]*group
+	draining  []*Proxy
+	direct    *Proxy
+	health    HealthConfig
+	transport TransportConfig
+	sticky    stickySessions
+
+	proxiesFile string
+	configFile  string
+}
+
+func NewPool(health HealthConfig, transport TransportConfig) *Pool {
+	health.setDefaults()
+	transport.setDefaults()
+	p := &Pool{
+		groups:    map[string]*group{DefaultGroup: newGroup(DefaultGroup)},
+		health:    health,
+		transport: transport,
+	}
+	p.direct = newProxy(p, ProxySpec{})
+	return p
+}
+
+func (p *Pool) HealthConfig() HealthConfig {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.health
+}
 
-func readProxies(f *os.File) []string {
-	scanner := bufio.NewScanner(f)
-	var proxies []string
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			panic(err)
+// SetProxies replaces the proxies of the default group, other groups are
+// removed.
+func (p *Pool) SetProxies(proxies []ProxySpec) {
+	p.SetGroups(map[string][]ProxySpec{DefaultGroup: proxies})
+}
+
+// SetGroups replaces all proxy groups. Proxies that are already in the pool
+// keep their client and health state, removed proxies are drained in the
+// background so that requests in flight through them are not interrupted.
+func (p *Pool) SetGroups(groups map[string][]ProxySpec) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	existing := make(map[string]*Proxy, len(p.proxies))
+	for _, proxy := range p.proxies {
+		existing[proxy.Spec.Key()] = proxy
+	}
+
+	built := make(map[string]*Proxy)
+	p.proxies = nil
+	p.groups = make(map[string]*group, len(groups)+1)
+	for _, name := range slices.Sorted(maps.Keys(groups)) {
+		g := newGroup(name)
+		for _, spec := range groups[name] {
+			key := spec.Key()
+			proxy, ok := built[key]
+			if !ok {
+				proxy, ok = existing[key]
+				if !ok {
+					proxy = newProxy(p, spec)
+				}
+				built[key] = proxy
+				p.proxies = append(p.proxies, proxy)
+			}
+			g.add(proxy, spec.Weight)
 		}
-		proxy := scanner.Text()
-		if len(proxy) < 5 {
+		p.groups[name] = g
+	}
+	if _, ok := p.groups[DefaultGroup]; !ok {
+		p.groups[DefaultGroup] = newGroup(DefaultGroup)
+	}
+
+	for key, proxy := range existing {
+		if _, ok := built[key]; ok {
 			continue
 		}
-		proxies = append(proxies, proxy)
+		p.draining = append(p.draining, proxy)
+		go p.drain(proxy)
 	}
-	return proxies
 }
 
-func GetProxy() string {
-	if len(availableProxies) == 0 {
-		return ""
+func (p *Pool) HasGroup(name string) bool {
+	if name == "" || name == DirectGroup {
+		return true
 	}
-	i := int(index.Add(1) % int32(len(availableProxies)))
-	return availableProxies[i]
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.groups[name]
+	return ok
 }
 
-func GetAllProxies() []string {
-	return availableProxies
+// GetProxy returns the next healthy proxy of the default group.
+func (p *Pool) GetProxy() *Proxy {
+	return p.GetProxyFromGroup(DefaultGroup)
 }
 
-func init() {
-	f, err := os.Open("proxies.txt")
-	if err != nil {
-		if !os.IsNotExist(err) {
-			panic(err)
+// GetProxyFromGroup returns the next healthy proxy of the group, an empty name
+// means the default group. When the group has no proxies the direct connection
+// is returned. When every proxy of the group is ejected the direct connection
+// is returned only if FallbackDirect is set, otherwise nil. Unknown groups
+// return nil.
+func (p *Pool) GetProxyFromGroup(name string) *Proxy {
+	if name == "" {
+		name = DefaultGroup
+	}
+	if name == DirectGroup {
+		return p.direct
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	g, ok := p.groups[name]
+	if !ok {
+		return nil
+	}
+	if len(g.proxies) == 0 {
+		return p.direct
+	}
+	if proxy := g.next(); proxy != nil {
+		return proxy
+	}
+	if p.health.FallbackDirect {
+		return p.direct
+	}
+	return nil
+}
+
+func (p *Pool) GetAllProxies() []*Proxy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Proxy(nil), p.proxies...)
+}
+
+func (p *Pool) Statuses() []ProxyStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	proxyGroups := make(map[*Proxy][]string)
+	for _, name := range slices.Sorted(maps.Keys(p.groups)) {
+		for _, proxy := range p.groups[name].proxies {
+			proxyGroups[proxy] = append(proxyGroups[proxy], name)
 		}
-	} else {
-		defer f.Close()
-		availableProxies = readProxies(f)
 	}
+
+	statuses := make([]ProxyStatus, 0, len(p.proxies)+len(p.draining)+1)
+	for _, proxy := range p.proxies {
+		status := proxy.Status()
+		status.Groups = proxyGroups[proxy]
+		statuses = append(statuses, status)
+	}
+	for _, proxy := range p.draining {
+		status := proxy.Status()
+		status.State = StateDraining
+		statuses = append(statuses, status)
+	}
+	status := p.direct.Status()
+	status.Groups = []string{DirectGroup}
+	statuses = append(statuses, status)
+	return statuses
 }
@@ -0,0 +1,161 @@
+package proxy_pool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	watchInterval = time.Second * 5
+	drainTimeout  = time.Minute * 5
+)
+
+// NewPoolFromFiles builds a pool from a proxy list and a pool config file.
+// Both files are optional, Reload reads them again.
+func NewPoolFromFiles(proxiesFile, configFile string, transport TransportConfig) (*Pool, error) {
+	cfg, groups, parseErr, err := readFiles(proxiesFile, configFile)
+	if err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		logrus.WithError(parseErr).Error("Invalid proxies skipped")
+	}
+	p := NewPool(cfg.Health, transport)
+	p.proxiesFile = proxiesFile
+	p.configFile = configFile
+	p.SetGroups(groups)
+	return p, nil
+}
+
+func readConfig(name string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(name)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&cfg)
+	return cfg, err
+}
+
+func readProxiesFile(name string) (proxies []ProxySpec, parseErr error, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return readProxies(f)
+}
+
+// readFiles reads the config file and the proxy list, the proxy list is added
+// to the default group. Invalid proxies are left out and reported in parseErr,
+// err is only set when a file cannot be read at all.
+func readFiles(proxiesFile, configFile string) (cfg Config, groups map[string][]ProxySpec, parseErr error, err error) {
+	cfg, err = readConfig(configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, nil, nil, fmt.Errorf("error reading %s: %w", configFile, err)
+	}
+
+	var errs []error
+	groups = make(map[string][]ProxySpec, len(cfg.Groups)+1)
+	for name, groupConfig := range cfg.Groups {
+		if name == DirectGroup {
+			errs = append(errs, fmt.Errorf("group %s is reserved", name))
+			continue
+		}
+		for i, entry := range groupConfig.Proxies {
+			spec, err := entry.spec()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("group %s proxy %d: %w", name, i+1, err))
+				continue
+			}
+			groups[name] = append(groups[name], spec)
+		}
+	}
+
+	proxies, proxiesErr, err := readProxiesFile(proxiesFile)
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, nil, nil, fmt.Errorf("error reading %s: %w", proxiesFile, err)
+	}
+	if proxiesErr != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", proxiesFile, proxiesErr))
+	}
+	groups[DefaultGroup] = append(groups[DefaultGroup], proxies...)
+
+	return cfg, groups, errors.Join(errs...), nil
+}
+
+// Reload re-reads the pool config and the proxy list. When a file cannot be
+// read the current state is kept, invalid proxies are skipped and returned in
+// the error.
+func (p *Pool) Reload() error {
+	cfg, groups, parseErr, err := readFiles(p.proxiesFile, p.configFile)
+	if err != nil {
+		return err
+	}
+	cfg.Health.setDefaults()
+
+	p.mu.Lock()
+	p.health = cfg.Health
+	p.mu.Unlock()
+	p.SetGroups(groups)
+
+	logrus.WithField("groups", len(groups)).WithField("proxies", len(p.GetAllProxies())).Info("Proxies reloaded")
+	return parseErr
+}
+
+func (p *Pool) drain(proxy *Proxy) {
+	deadline := time.Now().Add(drainTimeout)
+	for proxy.inFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+	}
+	// requests still running after the deadline keep their connections, only
+	// idle ones are closed
+	proxy.CloseIdleConnections()
+
+	p.mu.Lock()
+	p.draining = slices.DeleteFunc(p.draining, func(d *Proxy) bool {
+		return d == proxy
+	})
+	p.mu.Unlock()
+	logrus.WithField("proxy", proxy.Name()).Info("Proxy drained")
+}
+
+func modTime(name string) time.Time {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
+
+// WatchFiles reloads the pool whenever the proxy list or the config file
+// changes on disk, until stop is closed.
+func (p *Pool) WatchFiles(stop <-chan struct{}) {
+	go func() {
+		proxiesModTime, configModTime := modTime(p.proxiesFile), modTime(p.configFile)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			newProxiesModTime, newConfigModTime := modTime(p.proxiesFile), modTime(p.configFile)
+			if newProxiesModTime.Equal(proxiesModTime) && newConfigModTime.Equal(configModTime) {
+				continue
+			}
+			proxiesModTime, configModTime = newProxiesModTime, newConfigModTime
+			if err := p.Reload(); err != nil {
+				logrus.WithError(err).Error("Error reloading proxies")
+			}
+		}
+	}()
+}
@@ -0,0 +1,139 @@
+package proxy_pool
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stickySweepInterval = time.Minute
+	// maxStickySessions bounds the remembered clients, new clients are not
+	// remembered while it is reached
+	maxStickySessions = 100_000
+)
+
+type stickyEntry struct {
+	proxy     *Proxy
+	expiresAt time.Time
+}
+
+// stickySessions maps a client key to the proxy it was assigned to, so that a
+// client keeps its exit IP for as long as it stays active.
+type stickySessions struct {
+	mu      sync.Mutex
+	entries map[string]stickyEntry
+}
+
+func (s *stickySessions) get(key string) (*Proxy, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.proxy, true
+}
+
+// set assigns the client to proxy, it returns false when the client is new and
+// there are too many sessions.
+func (s *stickySessions) set(key string, proxy *Proxy, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]stickyEntry)
+	}
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= maxStickySessions {
+		return false
+	}
+	s.entries[key] = stickyEntry{
+		proxy:     proxy,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return true
+}
+
+// sweep removes the expired sessions.
+func (s *stickySessions) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, k)
+		}
+	}
+}
+
+func (s *stickySessions) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func stickyKey(group, clientKey string) string {
+	if group == "" {
+		group = DefaultGroup
+	}
+	return group + "\x00" + clientKey
+}
+
+func (p *Pool) inGroup(proxy *Proxy, name string) bool {
+	if name == "" {
+		name = DefaultGroup
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	g, ok := p.groups[name]
+	return ok && slices.Contains(g.proxies, proxy)
+}
+
+// GetStickyProxy returns the proxy the client identified by clientKey was
+// assigned to in the group, refreshing the assignment to expire after ttl.
+// Clients without one, or whose proxy became unhealthy or left the group, get
+// a proxy of the group that Stick assigns them to once it served them.
+func (p *Pool) GetStickyProxy(group, clientKey string, ttl time.Duration) *Proxy {
+	key := stickyKey(group, clientKey)
+	if proxy, ok := p.sticky.get(key); ok {
+		if proxy.Healthy() && p.inGroup(proxy, group) {
+			p.sticky.set(key, proxy, ttl)
+			return proxy
+		}
+		logrus.WithField("proxy", proxy.Name()).WithField("proxy_group", group).Info("Sticky proxy unavailable, reassigning client")
+	}
+	return p.GetProxyFromGroup(group)
+}
+
+// Stick assigns the client to proxy after a successful request, for ttl
+// without requests.
+func (p *Pool) Stick(group, clientKey string, proxy *Proxy, ttl time.Duration) {
+	// the direct connection always has the same exit IP, and remembering it
+	// would keep the client off the group after a fallback
+	if proxy == nil || proxy.IsDirect() {
+		return
+	}
+	if !p.sticky.set(stickyKey(group, clientKey), proxy, ttl) {
+		logrus.WithField("sessions", maxStickySessions).Debug("Too many sticky sessions, client not remembered")
+	}
+}
+
+// StartStickySweeps removes expired sticky sessions every minute, until stop
+// is closed.
+func (p *Pool) StartStickySweeps(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(stickySweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			p.sticky.sweep()
+		}
+	}()
+}
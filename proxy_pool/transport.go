@@ -0,0 +1,27 @@
+package proxy_pool
+
+import (
+	"time"
+	"website_proxier/duration"
+)
+
+// TransportConfig tunes the http clients of every proxy.
+type TransportConfig struct {
+	MaxIdleConns                int               `json:"max_idle_conns"`
+	IdleConnTimeout             duration.Duration `json:"idle_conn_timeout"`
+	TLSHandshakeTimeout         duration.Duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout       duration.Duration `json:"response_header_timeout"`
+	DirectResponseHeaderTimeout duration.Duration `json:"direct_response_header_timeout"` // without a proxy
+	RequestTimeout              duration.Duration `json:"request_timeout"`                // whole request including the body, streams excepted
+}
+
+func (c *TransportConfig) setDefaults() {
+	if c.MaxIdleConns <= 0 {
+		c.MaxIdleConns = 20
+	}
+	c.IdleConnTimeout.Duration = c.IdleConnTimeout.Or(time.Second * 30)
+	c.TLSHandshakeTimeout.Duration = c.TLSHandshakeTimeout.Or(time.Second * 5)
+	c.ResponseHeaderTimeout.Duration = c.ResponseHeaderTimeout.Or(time.Second * 40)
+	c.DirectResponseHeaderTimeout.Duration = c.DirectResponseHeaderTimeout.Or(time.Second * 5)
+	c.RequestTimeout.Duration = c.RequestTimeout.Or(time.Second * 40)
+}
@@ -0,0 +1,38 @@
+package redact
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Hook is a logrus hook that masks URL passwords in messages, errors and
+// string fields, and sensitive values in header fields. It is a safety net,
+// paths and headers should still be redacted where they are logged. Headers
+// are redacted with DefaultConfig when Redactor is nil.
+type Hook struct {
+	Redactor *Redactor
+}
+
+func (h Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h Hook) Fire(entry *logrus.Entry) error {
+	redactor := h.Redactor
+	if redactor == nil {
+		redactor = defaultRedactor
+	}
+	entry.Message = String(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = String(v)
+		case error:
+			entry.Data[key] = String(v.Error())
+		case http.Header:
+			entry.Data[key] = redactor.Header(v)
+		}
+	}
+	return nil
+}
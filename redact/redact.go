@@ -0,0 +1,161 @@
+// Package redact masks credentials and other sensitive values before they are
+// logged.
+package redact
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const Mask = "xxxxx"
+
+type Config struct {
+	Headers     []string `json:"headers"`      // header values masked entirely
+	Cookies     []string `json:"cookies"`      // cookie headers, only the values are masked
+	QueryParams []string `json:"query_params"` // query parameter values masked
+}
+
+var DefaultConfig = Config{
+	Headers:     []string{"Authorization", "Proxy-Authorization", "X-Api-Key", "X-Auth-Token", "X-Csrf-Token"},
+	Cookies:     []string{"Cookie", "Set-Cookie"},
+	QueryParams: []string{"token", "access_token", "refresh_token", "api_key", "apikey", "key", "password", "secret", "sig", "signature", "auth"},
+}
+
+type Redactor struct {
+	headers     map[string]bool
+	cookies     map[string]bool
+	queryParams map[string]bool
+}
+
+func canonicalSet(values []string, canonical func(string) string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[canonical(v)] = true
+	}
+	return set
+}
+
+func New(cfg Config) *Redactor {
+	return &Redactor{
+		headers:     canonicalSet(cfg.Headers, http.CanonicalHeaderKey),
+		cookies:     canonicalSet(cfg.Cookies, http.CanonicalHeaderKey),
+		queryParams: canonicalSet(cfg.QueryParams, strings.ToLower),
+	}
+}
+
+// Header returns a copy of h with sensitive values masked.
+func (r *Redactor) Header(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for key, values := range h {
+		canonical := http.CanonicalHeaderKey(key)
+		switch {
+		case r.headers[canonical]:
+			redacted[key] = []string{Mask}
+		case r.cookies[canonical]:
+			masked := make([]string, len(values))
+			for i, v := range values {
+				masked[i] = maskCookie(v)
+			}
+			redacted[key] = masked
+		default:
+			redacted[key] = values
+		}
+	}
+	return redacted
+}
+
+// maskCookie masks the values of a Cookie or Set-Cookie header, keeping the
+// cookie names and Set-Cookie attributes.
+func maskCookie(header string) string {
+	parts := strings.Split(header, ";")
+	for i, part := range parts {
+		name, _, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		// Set-Cookie attributes come after the first pair
+		if i > 0 && isCookieAttribute(strings.TrimSpace(name)) {
+			continue
+		}
+		parts[i] = name + "=" + Mask
+	}
+	return strings.Join(parts, ";")
+}
+
+func isCookieAttribute(name string) bool {
+	switch strings.ToLower(name) {
+	case "path", "domain", "expires", "max-age", "samesite":
+		return true
+	}
+	return false
+}
+
+// Query masks sensitive parameter values of a raw query string.
+func (r *Redactor) Query(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name, _, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		decoded, err := url.QueryUnescape(name)
+		if err != nil {
+			decoded = name
+		}
+		if r.queryParams[strings.ToLower(decoded)] {
+			params[i] = name + "=" + Mask
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// Path masks sensitive query parameters of a path with an optional query.
+func (r *Redactor) Path(path string) string {
+	p, query, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	return p + "?" + r.Query(query)
+}
+
+// URL masks the password and the sensitive query parameters of a URL.
+func (r *Redactor) URL(rawUrl string) string {
+	return r.Path(String(rawUrl))
+}
+
+// the password part is greedy, an unescaped @ in a password ends at the last one
+var userinfoRegex = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/@\s:]*):[^/\s]*@`)
+
+// String masks passwords of URLs embedded anywhere in s, like proxy URLs in
+// error messages.
+func String(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	return userinfoRegex.ReplaceAllString(s, "${1}:"+Mask+"@")
+}
+
+var defaultRedactor = New(DefaultConfig)
+
+// Header, Query, Path and URL redact with DefaultConfig.
+
+func Header(h http.Header) http.Header {
+	return defaultRedactor.Header(h)
+}
+
+func Query(rawQuery string) string {
+	return defaultRedactor.Query(rawQuery)
+}
+
+func Path(path string) string {
+	return defaultRedactor.Path(path)
+}
+
+func URL(rawUrl string) string {
+	return defaultRedactor.URL(rawUrl)
+}
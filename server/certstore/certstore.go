@@ -0,0 +1,206 @@
+// Package certstore picks TLS certificates by SNI from a directory of
+// <name>.crt / <name>.key pairs, reloading them when the files change.
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const watchInterval = time.Second * 10
+
+// maxGenerated bounds the self-signed certificates kept, host patterns let
+// clients ask for any number of names.
+const maxGenerated = 1000
+
+type Store struct {
+	dir        string
+	selfSigned bool
+	hosts      func() []string        // hosts the store is expected to serve, checked for certificates on reload
+	serves     func(name string) bool // whether a self-signed certificate may be made for name
+
+	mu          sync.RWMutex
+	certs       map[string]*tls.Certificate // by DNS name, wildcards included
+	generated   map[string]*tls.Certificate
+	fingerprint string
+}
+
+// New loads the certificates in dir. With selfSigned set, a self-signed
+// certificate is generated for any name without a certificate that serves
+// accepts. The store is returned along with errors about pairs that failed to
+// load.
+func New(dir string, selfSigned bool, hosts func() []string, serves func(name string) bool) (*Store, error) {
+	s := &Store{
+		dir:        dir,
+		selfSigned: selfSigned,
+		hosts:      hosts,
+		serves:     serves,
+		generated:  make(map[string]*tls.Certificate),
+	}
+	return s, s.Reload()
+}
+
+// fingerprintDir summarizes the names, sizes and modification times of the
+// certificate files, to notice changes.
+func fingerprintDir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(&b, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// Reload reads all certificate pairs of the directory. Pairs that fail to load
+// are skipped and reported in the returned error.
+func (s *Store) Reload() error {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	fingerprint, err := fingerprintDir(s.dir)
+	if err != nil {
+		return err
+	}
+	certFiles, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+	if err != nil {
+		return err
+	}
+
+	certs := make(map[string]*tls.Certificate)
+	var errs []error
+	for _, certFile := range certFiles {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(certFile), err))
+			continue
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(certFile), err))
+			continue
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			certs[strings.ToLower(name)] = &cert
+		}
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.fingerprint = fingerprint
+	s.mu.Unlock()
+
+	for _, host := range s.hosts() {
+		if s.lookup(host) == nil {
+			logrus.WithField("host", host).Warn("No certificate for mirror host")
+		}
+	}
+	logrus.WithField("dir", s.dir).WithField("names", len(certs)).Info("Certificates loaded")
+	return errors.Join(errs...)
+}
+
+// lookup returns the certificate for the exact name, or the wildcard
+// certificate of its parent domain.
+func (s *Store) lookup(name string) *tls.Certificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cert, ok := s.certs[name]; ok {
+		return cert
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.certs["*."+parent]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert := s.lookup(name); cert != nil {
+		return cert, nil
+	}
+	if s.selfSigned && name != "" && s.serves(name) {
+		return s.selfSignedCertificate(name)
+	}
+	return nil, fmt.Errorf("no certificate for %q", name)
+}
+
+func (s *Store) selfSignedCertificate(host string) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cert, ok := s.generated[host]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	cert, err := generateSelfSigned(host)
+	if err != nil {
+		return nil, err
+	}
+	// any one goes, it is generated again when asked for
+	for name := range s.generated {
+		if len(s.generated) < maxGenerated {
+			break
+		}
+		delete(s.generated, name)
+	}
+	s.generated[host] = cert
+	logrus.WithField("host", host).Info("Generated self-signed certificate")
+	return cert, nil
+}
+
+// Watch reloads the certificates whenever the directory changes, until stop
+// is closed.
+func (s *Store) Watch(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			fingerprint, err := fingerprintDir(s.dir)
+			if err != nil {
+				logrus.WithError(err).Error("Error reading certificate dir")
+				continue
+			}
+			s.mu.RLock()
+			changed := fingerprint != s.fingerprint
+			s.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				logrus.WithError(err).Error("Error reloading certificates")
+			}
+		}
+	}()
+}
@@ -0,0 +1,83 @@
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePair(t *testing.T, dir, name, host string) {
+	cert, err := generateSelfSigned(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "mirror", "mirror.example")
+	writePair(t, dir, "wildcard", "*.cdn.example")
+
+	hosts := func() []string { return []string{"mirror.example", "local.test"} }
+	// local.test and what a host pattern *.pattern.test matches
+	serves := func(name string) bool {
+		return name == "local.test" || strings.HasSuffix(name, ".pattern.test")
+	}
+	store, err := New(dir, true, hosts, serves)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{
+		"mirror.example": "mirror.example",
+		"a.cdn.example":  "*.cdn.example",
+		"local.test":     "local.test",
+		"Local.Test.":    "local.test",
+		"a.pattern.test": "a.pattern.test",
+	} {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if cert.Leaf.DNSNames[0] != expected {
+			t.Errorf("%s: expected certificate for %s, got %v", name, expected, cert.Leaf.DNSNames)
+		}
+	}
+
+	if _, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example"}); err == nil {
+		t.Error("expected no certificate for an unknown host")
+	}
+}
+
+func TestGeneratedBounded(t *testing.T) {
+	store, err := New(t.TempDir(), true, func() []string { return nil }, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range maxGenerated + 10 {
+		if _, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: fmt.Sprintf("%d.pattern.test", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(store.generated) > maxGenerated {
+		t.Errorf("expected at most %d generated certificates, got %d", maxGenerated, len(store.generated))
+	}
+}
@@ -0,0 +1,39 @@
+package http_server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (s *Server) writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		s.log.WithError(err).Error("Error writing json response")
+	}
+}
+
+func (s *Server) handleProxyStatus(w http.ResponseWriter, r *http.Request) {
+	s.writeJson(w, s.pool.Statuses())
+}
+
+func (s *Server) handleReloadProxies(w http.ResponseWriter, r *http.Request) {
+	err := s.pool.Reload()
+	if err != nil {
+		s.log.WithError(err).Error("Error reloading proxies")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	s.writeJson(w, s.pool.Statuses())
+}
+
+// AdminHandler serves proxy status, proxy reloads and metrics. It is meant
+// for a listener that is not reachable from the outside.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxies", s.handleProxyStatus)
+	mux.HandleFunc("/reload_proxies", s.handleReloadProxies)
+	mux.Handle("/metrics", s.metrics.registry)
+	return mux
+}
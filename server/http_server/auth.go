@@ -0,0 +1,130 @@
+package http_server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"website_proxier/siteconfig"
+
+	"github.com/sirupsen/logrus"
+)
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>Login</title></head>
+<body>
+<form method="post" action="{{.Action}}">
+{{if .Failed}}<p>Wrong user name or password.</p>{{end}}
+<input type="hidden" name="next" value="{{.Next}}">
+<p><label>User <input name="user" autocomplete="username" required autofocus></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password" required></label></p>
+<p><button type="submit">Log in</button></p>
+</form>
+</body>
+</html>
+`))
+
+// authorize enforces the access control of the site. It returns false when it
+// answered the request itself.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, site *siteconfig.WebsiteConfig, clientIP string, logr *logrus.Entry) bool {
+	auth := site.Auth
+	if auth == nil {
+		return true
+	}
+	if auth.Mode == siteconfig.AuthLogin && r.URL.Path == auth.LoginPath {
+		s.login(w, r, site, clientIP, logr)
+		return false
+	}
+	if auth.Exempt(r.URL.Path) {
+		return true
+	}
+
+	switch auth.Mode {
+	case siteconfig.AuthBasic:
+		user, password, ok := r.BasicAuth()
+		if ok {
+			if !s.loginAllowed(w, site, clientIP, logr) {
+				return false
+			}
+			if auth.CheckPassword(user, password) {
+				return true
+			}
+			auth.LoginFailed(clientIP)
+			logr.WithField("user", user).Warn("Wrong password")
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, auth.Realm))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case siteconfig.AuthLogin:
+		if cookie, err := r.Cookie(auth.CookieName); err == nil && auth.VerifySessionCookie(cookie.Value) {
+			return true
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			http.Redirect(w, r, auth.LoginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		} else {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		}
+	}
+	return false
+}
+
+// loginAllowed answers 429 and returns false when the client has used up its
+// failed logins, before any password of it is checked.
+func (s *Server) loginAllowed(w http.ResponseWriter, site *siteconfig.WebsiteConfig, clientIP string, logr *logrus.Entry) bool {
+	ok, retryAfter := site.Auth.LoginAllowed(clientIP)
+	if !ok {
+		s.tooManyRequests(w, site, "ip_failed_logins", retryAfter, logr)
+	}
+	return ok
+}
+
+// login serves the login page and sets the session cookie once the right
+// password is posted.
+func (s *Server) login(w http.ResponseWriter, r *http.Request, site *siteconfig.WebsiteConfig, clientIP string, logr *logrus.Entry) {
+	auth := site.Auth
+	next := r.FormValue("next")
+	// only local paths, anything else would make this an open redirect
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	failed := false
+	if r.Method == http.MethodPost {
+		if !s.loginAllowed(w, site, clientIP, logr) {
+			return
+		}
+		user := r.PostFormValue("user")
+		if auth.CheckPassword(user, r.PostFormValue("password")) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     auth.CookieName,
+				Value:    auth.SessionCookie(user),
+				Path:     "/",
+				MaxAge:   int(auth.CookieTTL.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			logr.WithField("user", user).Info("Logged in")
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		auth.LoginFailed(clientIP)
+		logr.WithField("user", user).Warn("Wrong password")
+		failed = true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if failed {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	err := loginPage.Execute(w, struct {
+		Action string
+		Next   string
+		Failed bool
+	}{auth.LoginPath, next, failed})
+	if err != nil {
+		logr.WithError(err).Error("Error rendering login page")
+	}
+}
@@ -0,0 +1,71 @@
+package http_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHash is the bcrypt hash of "secret".
+func testHash(t *testing.T) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestExemptPathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	writeSite(t, dir, "a", "example.com", "a.test", `{"auth": {"users": {"alice": "`+testHash(t)+`"}, "exempt_paths": ["/static/*"]}}`)
+	s, err := New(Options{ConfigDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/static/../admin", "/static/%2e%2e/admin", "/static/..%2fadmin", "/static//../../admin"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://a.test"+target, nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", target, rec.Code)
+		}
+	}
+}
+
+func TestPathForwardedAsSent(t *testing.T) {
+	paths := make(chan string, 1)
+	s, _ := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}), `{"no_cache": true, "auth": {"users": {"alice": "`+testHash(t)+`"}, "exempt_paths": ["/static/*"]}}`, false)
+
+	// only the auth decision sees the cleaned path
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://mirror.test/static//css/../app.css", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the exempt path to be served, got %d", rec.Code)
+	}
+	if got := <-paths; got != "/static//css/../app.css" {
+		t.Errorf("expected the path to reach the upstream as sent, got %q", got)
+	}
+}
+
+func TestFailedLoginsLimited(t *testing.T) {
+	dir := t.TempDir()
+	writeSite(t, dir, "a", "example.com", "a.test", `{"auth": {"users": {"alice": "`+testHash(t)+`"}, "failed_logins": {"rate": 0.01, "burst": 3}}}`)
+	s, err := New(Options{ConfigDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{401, 401, 401, 429} {
+		req := httptest.NewRequest(http.MethodGet, "http://a.test/", nil)
+		req.SetBasicAuth("mallory", "guess")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("attempt %d: expected %d, got %d", i+1, want, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package http_server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"website_proxier/ipfilter"
+)
+
+// DefaultTrustedProxies are loopback and private networks, where a load
+// balancer in front of the server usually sits.
+var DefaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+// parseHostAddr parses an address with or without a port, IPv6 optionally in
+// brackets, as found in RemoteAddr and forwarding headers.
+func parseHostAddr(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// forwardedFor returns the for= addresses of a Forwarded header (RFC 7239),
+// closest to the client first.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedHops returns the client address chain reported by the proxies in
+// front, closest to the client first. Forwarded wins over X-Forwarded-For,
+// which wins over X-Real-IP.
+func forwardedHops(r *http.Request) []string {
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		return forwardedFor(values)
+	}
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		var hops []string
+		for _, value := range values {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+		return hops
+	}
+	if value := r.Header.Get("X-Real-IP"); value != "" {
+		return []string{value}
+	}
+	return nil
+}
+
+// clientIP returns the address of the client. Forwarding headers are only
+// believed when the connection comes from a trusted proxy, the client is then
+// the rightmost hop that is not a trusted proxy itself.
+func (s *Server) clientIP(r *http.Request) netip.Addr {
+	addr, ok := parseHostAddr(r.RemoteAddr)
+	if !ok {
+		return netip.Addr{}
+	}
+
+	hops := forwardedHops(r)
+	for i := len(hops) - 1; i >= 0 && ipfilter.Contains(s.trustedProxies, addr); i-- {
+		hop, ok := parseHostAddr(hops[i])
+		if !ok {
+			// unknown or obfuscated, the proxy that added it is as far as we get
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+// clientKey identifies the client for rate limits and sticky sessions. Peers
+// whose address does not parse are keyed by their raw RemoteAddr rather than
+// all sharing the invalid address.
+func clientKey(r *http.Request, addr netip.Addr) string {
+	if !addr.IsValid() {
+		return r.RemoteAddr
+	}
+	return addr.String()
+}
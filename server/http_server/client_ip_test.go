@@ -0,0 +1,54 @@
+package http_server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"website_proxier/ipfilter"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ipfilter.ParsePrefixes([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: trusted}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"rightmost untrusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 192.0.2.1"}, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"invalid hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, garbage"}, "10.0.0.1"},
+		{"forwarded", "10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8::1]:4711"`, "X-Forwarded-For": "1.1.1.1"}, "2001:db8::1"},
+		{"real ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"mapped", "[::ffff:203.0.113.7]:1234", nil, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for key, value := range tt.headers {
+			r.Header.Set(key, value)
+		}
+		if got := s.clientIP(r).String(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	s := &Server{}
+	keys := make(map[string]bool)
+	for _, remoteAddr := range []string{"203.0.113.7:1234", "pipe-1", "pipe-2"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		keys[clientKey(r, s.clientIP(r))] = true
+	}
+	if len(keys) != 3 || !keys["203.0.113.7"] || !keys["pipe-1"] {
+		t.Errorf("expected unparsable peers to keep their own keys, got %v", keys)
+	}
+}
@@ -0,0 +1,238 @@
+package http_server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"website_proxier/accesslog"
+	"website_proxier/duration"
+	"website_proxier/ipfilter"
+	"website_proxier/proxy_pool"
+	"website_proxier/redact"
+	"website_proxier/siteconfig"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultConfigFile = "server.json"
+	envPrefix         = "WEBSITE_PROXIER_"
+)
+
+type TLSConfig struct {
+	Listen       string `json:"listen"` // the HTTPS listener is off when empty
+	CertDir      string `json:"cert_dir"`
+	RedirectHTTP bool   `json:"redirect_http"` // redirect plain HTTP requests to HTTPS
+	SelfSigned   bool   `json:"self_signed"`   // generate certificates for mirror hosts without one, for local testing
+}
+
+type ShutdownConfig struct {
+	Timeout   duration.Duration `json:"timeout"`    // how long in-flight requests get to finish
+	CacheFile string            `json:"cache_file"` // page cache saved on shutdown and loaded on start, off when empty
+}
+
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"` // text or json
+}
+
+type CacheConfig struct {
+	TTL duration.Duration `json:"ttl"`
+}
+
+type AdminConfig struct {
+	Listen string `json:"listen"` // the admin listener is off when empty
+}
+
+type Config struct {
+	Listen          string                     `json:"listen"`
+	ConfigDir       string                     `json:"config_dir"` // one directory per site
+	ProxiesFile     string                     `json:"proxies_file"`
+	ProxyPoolConfig string                     `json:"proxy_pool_config"`
+	Upstream        proxy_pool.TransportConfig `json:"upstream"`
+	Log             LogConfig                  `json:"log"`
+	AccessLog       accesslog.Config           `json:"access_log"` // off when the path is empty
+	Cache           CacheConfig                `json:"cache"`
+	Admin           AdminConfig                `json:"admin"`
+	Redact          *redact.Config             `json:"redact"` // redact.DefaultConfig when unset
+	TLS             TLSConfig                  `json:"tls"`
+	H2C             bool                       `json:"h2c"` // accept HTTP/2 with prior knowledge on the plain HTTP listener
+	Shutdown        ShutdownConfig             `json:"shutdown"`
+	TrustedProxies  []string                   `json:"trusted_proxies"`  // CIDRs whose forwarding headers are believed
+	IPFilter        *ipfilter.Config           `json:"ip_filter"`        // applies to every site
+	UnknownHost     *siteconfig.HostResponse   `json:"unknown_host"`     // siteconfig.DefaultUnknownHost when unset
+	DeactivatedHost *siteconfig.HostResponse   `json:"deactivated_host"` // for deactivated sites without their own, like unknown hosts when unset
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:          ":6688",
+		ConfigDir:       "configs_v2",
+		ProxiesFile:     "proxies.txt",
+		ProxyPoolConfig: "proxy_pool.json",
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		AccessLog: accesslog.Config{
+			// opt-in, with the rotation defaults for when a path is set
+			Format:     accesslog.FormatJSON,
+			MaxSizeMB:  100,
+			MaxBackups: 10,
+		},
+		Cache: CacheConfig{
+			TTL: duration.Duration{Duration: time.Minute * 120},
+		},
+		Admin: AdminConfig{
+			Listen: "127.0.0.1:6689",
+		},
+		TLS: TLSConfig{
+			CertDir: "certs",
+		},
+		Shutdown: ShutdownConfig{
+			Timeout: duration.Duration{Duration: time.Second * 30},
+		},
+		TrustedProxies: DefaultTrustedProxies,
+	}
+}
+
+// readConfig reads the server config over the defaults, a missing file gives
+// the defaults.
+func readConfig(name string, cfg *Config) error {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(cfg)
+}
+
+// override is a setting that can be changed with a flag, or with the
+// environment variable named after it, e.g. -config-dir and
+// WEBSITE_PROXIER_CONFIG_DIR.
+type override struct {
+	name  string
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+func (o override) env() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+func setString(field func(cfg *Config) *string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+func setDuration(field func(cfg *Config) *duration.Duration) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field(cfg).Duration = d
+		return nil
+	}
+}
+
+func setList(field func(cfg *Config) *[]string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(cfg) = list
+		return nil
+	}
+}
+
+var overrides = []override{
+	{"listen", "address of the HTTP listener", setString(func(cfg *Config) *string { return &cfg.Listen })},
+	{"tls-listen", "address of the HTTPS listener, off when empty", setString(func(cfg *Config) *string { return &cfg.TLS.Listen })},
+	{"admin-listen", "address of the admin listener, off when empty", setString(func(cfg *Config) *string { return &cfg.Admin.Listen })},
+	{"config-dir", "directory with one directory per site", setString(func(cfg *Config) *string { return &cfg.ConfigDir })},
+	{"proxies", "proxy list file", setString(func(cfg *Config) *string { return &cfg.ProxiesFile })},
+	{"proxy-pool-config", "proxy pool config file", setString(func(cfg *Config) *string { return &cfg.ProxyPoolConfig })},
+	{"log-level", "log level", setString(func(cfg *Config) *string { return &cfg.Log.Level })},
+	{"log-format", "log format, text or json", setString(func(cfg *Config) *string { return &cfg.Log.Format })},
+	{"access-log", "access log file, off when empty", setString(func(cfg *Config) *string { return &cfg.AccessLog.Path })},
+	{"cache-ttl", "how long cached pages are served", setDuration(func(cfg *Config) *duration.Duration { return &cfg.Cache.TTL })},
+	{"cache-file", "page cache file kept across restarts, off when empty", setString(func(cfg *Config) *string { return &cfg.Shutdown.CacheFile })},
+	{"trusted-proxies", "comma separated CIDRs whose forwarding headers are believed, none when empty", setList(func(cfg *Config) *[]string { return &cfg.TrustedProxies })},
+	{"request-timeout", "upstream request timeout", setDuration(func(cfg *Config) *duration.Duration { return &cfg.Upstream.RequestTimeout })},
+}
+
+// loadConfig builds the server config from the defaults, the config file, the
+// environment and the command line, later ones win.
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("website_proxier", flag.ExitOnError)
+	configFile := flags.String("config", defaultConfigFile, "server config file (env "+envPrefix+"CONFIG)")
+	values := make(map[string]*string, len(overrides))
+	for _, o := range overrides {
+		values[o.name] = flags.String(o.name, "", o.usage+" (env "+o.env()+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	name := *configFile
+	if env := getenv(envPrefix + "CONFIG"); env != "" && !isFlagSet(flags, "config") {
+		name = env
+	}
+	if err := readConfig(name, &cfg); err != nil {
+		return cfg, fmt.Errorf("error reading %s: %w", name, err)
+	}
+
+	for _, o := range overrides {
+		value := getenv(o.env())
+		if isFlagSet(flags, o.name) {
+			value = *values[o.name]
+		} else if value == "" {
+			continue
+		}
+		if err := o.set(&cfg, value); err != nil {
+			return cfg, fmt.Errorf("invalid %s: %w", o.name, err)
+		}
+	}
+	return cfg, nil
+}
+
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// setupLogging applies the log level and format.
+func setupLogging(cfg LogConfig) error {
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+
+	switch cfg.Format {
+	case "text", "":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %s", cfg.Format)
+	}
+	return nil
+}
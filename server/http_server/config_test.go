@@ -0,0 +1,49 @@
+package http_server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.json")
+	err := os.WriteFile(name, []byte(`{"listen": ":7000", "config_dir": "sites", "admin": {"listen": ""}, "cache": {"ttl": "5m"}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"WEBSITE_PROXIER_CONFIG":     name,
+		"WEBSITE_PROXIER_LISTEN":     ":7001",
+		"WEBSITE_PROXIER_LOG_LEVEL":  "debug",
+		"WEBSITE_PROXIER_CACHE_TTL":  "not a duration",
+		"WEBSITE_PROXIER_CONFIG_DIR": "",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	if _, err := loadConfig(nil, getenv); err == nil {
+		t.Fatal("expected an error for an invalid duration")
+	}
+	env["WEBSITE_PROXIER_CACHE_TTL"] = ""
+
+	cfg, err := loadConfig([]string{"-listen", ":7002", "-proxies", "other.txt"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":7002" || cfg.ProxiesFile != "other.txt" {
+		t.Errorf("flags not applied: listen %q, proxies %q", cfg.Listen, cfg.ProxiesFile)
+	}
+	if cfg.Log.Level != "debug" {
+		t.Errorf("environment not applied: log level %q", cfg.Log.Level)
+	}
+	if cfg.ConfigDir != "sites" || cfg.Admin.Listen != "" || cfg.Cache.TTL.Duration != time.Minute*5 {
+		t.Errorf("config file not applied: %+v", cfg)
+	}
+	if cfg.ProxyPoolConfig != "proxy_pool.json" {
+		t.Errorf("default lost: proxy pool config %q", cfg.ProxyPoolConfig)
+	}
+	if cfg.AccessLog.Path != "" {
+		t.Errorf("expected the access log to be off by default, got %q", cfg.AccessLog.Path)
+	}
+}
@@ -0,0 +1,38 @@
+package http_server
+
+import (
+	"net/http"
+	"strconv"
+	"website_proxier/siteconfig"
+)
+
+// upstreamFailure answers a request the upstream could not serve, with the
+// error page of the site when it has one and message otherwise.
+func upstreamFailure(w http.ResponseWriter, r *http.Request, site *siteconfig.WebsiteConfig, failure siteconfig.Failure, message string) {
+	if !writeErrorPage(w, r, site, failure, failure.Status()) {
+		http.Error(w, message, failure.Status())
+	}
+}
+
+// writeErrorPage sends the error page of the site for the failure, it returns
+// false without writing anything when the site has none.
+func writeErrorPage(w http.ResponseWriter, r *http.Request, site *siteconfig.WebsiteConfig, failure siteconfig.Failure, status int) bool {
+	body, contentType, ok := site.ErrorPage(failure, r.URL.Path, map[string]string{
+		"status":      strconv.Itoa(status),
+		"status_text": http.StatusText(status),
+		"failure":     string(failure),
+		"request_id":  getRequestInfo(r).id,
+		"host":        r.Host,
+		"path":        r.URL.Path,
+	})
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	return true
+}
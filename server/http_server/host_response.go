@@ -0,0 +1,53 @@
+package http_server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"website_proxier/siteconfig"
+)
+
+// statusConnectionClosed is logged for connections closed without a response,
+// as nginx does.
+const statusConnectionClosed = 444
+
+// serveHostResponse answers a request for an unknown or deactivated host.
+func serveHostResponse(w http.ResponseWriter, r *http.Request, response *siteconfig.HostResponse) {
+	switch response.Action {
+	case siteconfig.HostClose:
+		closeConnection(w)
+		return
+	case siteconfig.HostRedirect:
+		w.Header().Set("Location", response.Location)
+		w.WriteHeader(response.Status)
+		return
+	case siteconfig.HostUnavailable:
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(response.RetryAfter.Seconds()))))
+	}
+
+	body, contentType := response.Body, response.ContentType
+	if body == "" {
+		body, contentType = http.StatusText(response.Status), "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(response.Status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+// closeConnection drops the client connection without a response. HTTP/2
+// connections cannot be taken over, only the stream is reset there, by
+// aborting the handler.
+func closeConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.status = statusConnectionClosed
+	}
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	_ = conn.Close()
+}
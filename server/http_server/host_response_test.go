@@ -0,0 +1,130 @@
+package http_server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"website_proxier/accesslog"
+	"website_proxier/duration"
+	"website_proxier/siteconfig"
+)
+
+func TestHostResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		response siteconfig.HostResponse
+		status   int
+		headers  map[string]string
+		body     string
+	}{
+		{"redirect", siteconfig.HostResponse{Action: siteconfig.HostRedirect, Location: "https://example.com/"}, http.StatusFound,
+			map[string]string{"Location": "https://example.com/"}, ""},
+		{"page", siteconfig.HostResponse{Action: siteconfig.HostPage, Body: "<p>parked</p>"}, http.StatusOK,
+			map[string]string{"Content-Type": "text/html; charset=utf-8", "Cache-Control": "no-store"}, "<p>parked</p>"},
+		{"status", siteconfig.HostResponse{Action: siteconfig.HostStatus, Status: http.StatusGone}, http.StatusGone,
+			map[string]string{"Content-Type": "text/plain; charset=utf-8"}, "Gone"},
+		{"unavailable", siteconfig.HostResponse{Action: siteconfig.HostUnavailable, RetryAfter: duration.Duration{Duration: time.Minute + time.Millisecond}}, http.StatusServiceUnavailable,
+			map[string]string{"Retry-After": "61"}, "Service Unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(Options{ConfigDir: t.TempDir(), UnknownHost: &tt.response})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://unknown.test/", nil))
+			if rec.Code != tt.status {
+				t.Errorf("expected %d, got %d", tt.status, rec.Code)
+			}
+			for name, value := range tt.headers {
+				if got := rec.Header().Get(name); got != value {
+					t.Errorf("expected %s %q, got %q", name, value, got)
+				}
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("expected %q, got %q", tt.body, rec.Body.String())
+			}
+
+			rec = httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "http://unknown.test/", nil))
+			if rec.Code != tt.status || rec.Body.Len() != 0 {
+				t.Errorf("expected a HEAD request to get %d without a body, got %d %q", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestDeactivatedHostResponse(t *testing.T) {
+	dir := t.TempDir()
+	writeSite(t, dir, "a", "example.com", "mirror.test", `{}`)
+	if err := os.WriteFile(filepath.Join(dir, "a", "config.json"), []byte(`{"websites": {"example.com": "mirror.test"}, "deactivated": true}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{ConfigDir: dir, DeactivatedHost: &siteconfig.HostResponse{Action: siteconfig.HostStatus, Status: http.StatusUnavailableForLegalReasons}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://mirror.test/", nil))
+	if rec.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("expected the deactivated host response, got %d", rec.Code)
+	}
+}
+
+func TestHostClose(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "access.log")
+	s, err := New(Options{
+		ConfigDir:   t.TempDir(),
+		AccessLog:   accesslog.Config{Path: logFile},
+		UnknownHost: &siteconfig.HostResponse{Action: siteconfig.HostClose},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// HTTP/1 connections are closed without a response
+	server := httptest.NewServer(s)
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: unknown.test\r\n\r\n")
+	if got, err := io.ReadAll(conn); err != nil || len(got) != 0 {
+		t.Errorf("expected the connection to be closed without a response, got %q, %v", got, err)
+	}
+
+	// connections that cannot be taken over, like HTTP/2, abort the handler
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("expected the handler to be aborted, got %v", p)
+			}
+		}()
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://unknown.test/", nil))
+	}()
+
+	// both are recorded
+	log, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(log), `"status":444`); got != 2 {
+		t.Errorf("expected 2 closed connections in the access log, got %d:\n%s", got, log)
+	}
+	var metrics bytes.Buffer
+	s.metrics.registry.Write(&metrics)
+	if !strings.Contains(metrics.String(), `website_proxier_requests_total{site="unknown",host="unknown",status="444",cache="none"} 2`) {
+		t.Errorf("expected 2 closed connections in the metrics, got:\n%s", metrics.String())
+	}
+}
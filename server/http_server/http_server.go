@@ -2,15 +2,19 @@ package http_server
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"net"
 	"net/http"
-	"net/url"
+	"os"
 	"slices"
+	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 	"website_proxier/encoding"
 	"website_proxier/proxy_pool"
+	"website_proxier/redact"
+	"website_proxier/server/listeners"
 	"website_proxier/siteconfig"
 
 	"github.com/sirupsen/logrus"
@@ -37,60 +41,159 @@ var noStripHeadersFrom = []string{
 }
 
 var stripHeaders = []string{
-	"cdn-loop", "cf-connecting-ip", "cf-ipcountry", "cf-ray", "cf-visitor", "x-forwarded-for", "x-forwarded-proto", "x-real-ip",
+	"cdn-loop", "cf-connecting-ip", "cf-ipcountry", "cf-ray", "cf-visitor", "forwarded", "x-forwarded-for", "x-forwarded-proto", "x-real-ip",
 }
 
-const httpClientTtl = time.Minute * 5
+func newUpstreamRequest(r *http.Request, site *siteconfig.WebsiteConfig, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, site.URL(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
 
-type httpClientWithTtl struct {
-	Client     *http.Client
-	LastUsedAt time.Time
-}
+	for key, value := range r.Header {
+		// Upgrade is only sent by proxyUpgrade, an upstream switching protocols
+		// on a normal request would leave it hanging
+		if key == "Origin" || key == "Referer" || key == "Upgrade" || slices.Contains(stripHeaders, strings.ToLower(key)) {
+			continue
+		}
+		req.Header.Set(key, value[0])
+	}
 
-var httpClients []*httpClientWithTtl
-var httpClientIndex = atomic.Uint64{}
+	req.Header.Set("Origin", strings.Replace(r.Header.Get("Origin"), r.Host, site.TargetHost, 1))
+	req.Header.Set("Referer", strings.Replace(r.Header.Get("Referer"), r.Host, site.TargetHost, 1))
 
-func getHttpClient() *httpClientWithTtl {
-	if len(httpClients) == 1 {
-		return httpClients[0]
+	if referrer := r.Header.Get("Referer"); referrer != "" {
+		referrer = strings.Replace(referrer, r.Host, site.TargetHost, 1)
+		req.Header.Set("Referer", referrer)
 	}
-	index := httpClientIndex.Add(1)
-	return httpClients[index%uint64(len(httpClients))]
+
+	req.Header.Set("Host", site.TargetHost)
+	req.Header.Set("Connection", "keep-alive")
+
+	// cookies and credentials of our own stay here
+	var ownCookies []string
+	if site.StickySession != nil && site.StickySession.By == siteconfig.StickyByCookie {
+		ownCookies = append(ownCookies, site.StickySession.CookieName)
+	}
+	if site.Auth != nil {
+		switch site.Auth.Mode {
+		case siteconfig.AuthBasic:
+			req.Header.Del("Authorization")
+		case siteconfig.AuthLogin:
+			ownCookies = append(ownCookies, site.Auth.CookieName)
+		}
+	}
+	if len(ownCookies) > 0 {
+		cookie := req.Header.Get("Cookie")
+		for _, name := range ownCookies {
+			cookie = stripCookie(cookie, name)
+		}
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		} else {
+			req.Header.Del("Cookie")
+		}
+	}
+
+	if site.ForwardRequestId {
+		req.Header.Set(requestIdHeader, getRequestInfo(r).id)
+	} else {
+		req.Header.Del(requestIdHeader)
+	}
+
+	for k, v := range site.ReqHeadersOverride {
+		req.Header.Set(k, v)
+	}
+	return req, nil
 }
-func isRemoteAddrLocal(remoteAddr string) bool {
-	if strings.HasPrefix(remoteAddr, "127.") {
-		return true
+
+// responseHeaders returns the headers passed on to the client from an upstream
+// response, without Content-Length.
+func responseHeaders(resp *http.Response, site *siteconfig.WebsiteConfig, path string) map[string]string {
+	var headers = make(map[string]string)
+	for key, value := range resp.Header {
+		headers[key] = value[0]
 	}
-	if strings.HasPrefix(remoteAddr, "192.168.") {
-		return true
+
+	shouldStripHeaders := true
+	for _, ext := range noStripHeadersFrom {
+		if strings.HasSuffix(path, ext) {
+			shouldStripHeaders = false
+			break
+		}
 	}
-	if strings.HasPrefix(remoteAddr, "10.") {
-		return true
+	if shouldStripHeaders {
+		for _, header := range stripHeaders {
+			delete(headers, header)
+		}
 	}
-	if strings.HasPrefix(remoteAddr, "localhost") {
-		return true
+
+	for k, v := range site.RespHeadersOverride {
+		headers[k] = v
 	}
 
-	return false
+	delete(headers, "Content-Length")
+	return headers
 }
 
-func HandleRequest(w http.ResponseWriter, r *http.Request) {
-	logrus.WithFields(logrus.Fields{
+func (s *Server) serveFromCache(w http.ResponseWriter, r *http.Request, site *siteconfig.WebsiteConfig, entry *siteconfig.PageCacheEntry, info *requestInfo, logr *logrus.Entry) {
+	for key, value := range entry.Headers {
+		w.Header().Set(key, value)
+	}
+	for key, value := range site.RespHeadersOverride {
+		w.Header().Set(key, value)
+	}
+	w.Header().Del("Content-Length")
+	replaced := s.replace(site, entry.Content, &info.spans)
+	endEncode := info.spans.start("encode")
+	body, retEncoding, err := encoding.EncodeWithSomething(replaced, r.Header.Get("Accept-Encoding"))
+	endEncode()
+	if err != nil {
+		logr.WithError(err).Error("Error encoding body")
+		http.Error(w, "Error encoding body", http.StatusInternalServerError)
+		return
+	}
+	if retEncoding != "" {
+		w.Header().Set("Content-Encoding", retEncoding)
+	}
+	wasReplaced := len(body) != len(entry.Content) || bytes.Compare(body, entry.Content) != 0
+	if wasReplaced {
+		for _, header := range cacheRelatedHeaders {
+			delete(w.Header(), header)
+		}
+		w.Header().Set("X-Replaced", "1")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Pragma", "no-cache")
+	}
+	w.WriteHeader(entry.Status)
+	_, _ = w.Write(body)
+}
+
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	info := getRequestInfo(r)
+
+	info.log.WithFields(logrus.Fields{
 		"method": r.Method,
 		"host":   r.Host,
 		"path":   r.URL.Path,
 	}).Info("Received request")
+	if !s.ipFilter.Allows(info.clientIP) {
+		info.log.WithField("client_ip", info.clientIP.String()).Warn("Client IP denied")
+		s.ipFilter.Deny(w)
+		return
+	}
 	host := r.Host
 	if host == "" {
-		logrus.Warn("Host is empty")
+		info.log.Warn("Host is empty")
 		http.Error(w, "Host is empty", http.StatusBadRequest)
 		return
 	}
 	path := r.URL.Path
 
 	if path == "/reload_all_configs" {
-		_ = siteconfig.LoadAllSites()
-		logrus.Info("All configs reloaded")
+		_ = s.sites.LoadAllSites()
+		info.log.Info("All configs reloaded")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -98,54 +201,79 @@ func HandleRequest(w http.ResponseWriter, r *http.Request) {
 	if strings.HasPrefix(path, "/reload_specific_config") {
 		configName := r.URL.Query().Get("config_name")
 		if configName == "" {
-			logrus.Warn("Host is empty")
+			info.log.Warn("Host is empty")
 			http.Error(w, "Host is empty", http.StatusBadRequest)
 			return
 		}
-		config, ok := siteconfig.GetBaseConfigByName(configName)
+		config, ok := s.sites.GetBaseConfigByName(configName)
 		if !ok {
-			logrus.WithField("config_name", configName).Warn("Config not found")
+			info.log.WithField("config_name", configName).Warn("Config not found")
 			http.Error(w, "Config not found", http.StatusNotFound)
+			return
 		}
 
 		err := config.Load()
 		if err != nil {
-			logrus.WithError(err).Error("Error reloading config")
+			info.log.WithError(err).Error("Error reloading config")
 			http.Error(w, "Error reloading config", http.StatusInternalServerError)
 			return
 		}
-		logrus.WithField("config_name", configName).Info("Config reloaded")
+		info.log.WithField("config_name", configName).Info("Config reloaded")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	site, ok := siteconfig.GetSiteConfig(host)
-	if !ok || site.BaseConfig.Deactivated {
-		logrus.WithFields(logrus.Fields{
+	site, ok := s.sites.GetSiteConfig(host)
+	if !ok {
+		info.log.WithFields(logrus.Fields{
 			"host": host,
 		}).Warn("Website not found")
-		w.Header().Set("Location", "https://www.godaddy.com/websites/website-builder")
-		w.WriteHeader(http.StatusFound)
+		serveHostResponse(w, r, s.unknownHost)
 		return
 	}
 
-	remoteAddr := r.RemoteAddr
+	info.site = site
+	if site.BaseConfig.Deactivated {
+		info.log.WithFields(site.LogrusFields()).Warn("Website deactivated")
+		response := site.BaseConfig.Unavailable
+		if response == nil {
+			response = s.deactivatedHost
+		}
+		serveHostResponse(w, r, response)
+		return
+	}
+	clientIP := clientKey(r, info.clientIP)
 
-	if xForwardedFor := r.Header.Get("X-Real-IP"); xForwardedFor != "" && isRemoteAddrLocal(remoteAddr) {
-		remoteAddr = xForwardedFor
+	if filter := site.Filter(); !filter.Allows(info.clientIP) {
+		info.log.WithFields(site.LogrusFields()).WithField("client_ip", clientIP).Warn("Client IP denied")
+		filter.Deny(w)
+		return
 	}
 
 	if r.URL.RawQuery != "" {
 		path += "?" + r.URL.RawQuery
 	}
 	if site.ShouldBlock(path) {
-		logrus.WithFields(site.LogrusFields()).WithField("path", path).WithField("remote_addr", remoteAddr).Warn("Blocked")
+		info.log.WithFields(site.LogrusFields()).WithField("path", s.redactor.Path(path)).WithField("client_ip", clientIP).Warn("Blocked")
 		http.Error(w, "", http.StatusForbidden)
+		return
 	}
-	logr := logrus.WithFields(site.LogrusFields()).WithField("path", path).WithField("remote_addr", remoteAddr).WithField("host", host)
+	logr := info.log.WithFields(site.LogrusFields()).WithField("path", s.redactor.Path(path)).WithField("client_ip", clientIP).WithField("host", host)
 	//logr.Info("Handling request")
 	startedAt := time.Now()
 
+	// before the password checks, bcrypt is expensive
+	release, ok := site.RateLimiter().Acquire(clientIP)
+	if !ok {
+		s.tooManyRequests(w, site, "ip_concurrency", time.Second, logr)
+		return
+	}
+	defer release()
+
+	if !s.authorize(w, r, site, clientIP, logr) {
+		return
+	}
+
 	if path == "/reload_config" {
 		_ = site.BaseConfig.Load()
 		logr.Info("Config reloaded")
@@ -154,172 +282,254 @@ func HandleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer func() {
-		logr.WithField("duration", time.Since(startedAt).Round(time.Millisecond)).Info("Request finished")
+		logr.WithFields(logrus.Fields{
+			"duration": time.Since(startedAt).Round(time.Millisecond),
+			"attempts": info.attempts,
+			"proxies":  info.proxies,
+		}).WithFields(info.spans.logrusFields()).Info("Request finished")
 	}()
 
 	if r.Header.Get("Content-Encoding") == "identity" {
 		r.Header.Del("Content-Encoding")
 	}
 
-	if entry, ok := site.ProbeCache(path); ok {
-		logr.Info("Returning from cache")
-		for key, value := range entry.Headers {
-			w.Header().Set(key, value)
-		}
-		for key, value := range site.RespHeadersOverride {
-			w.Header().Set(key, value)
-		}
-		w.Header().Del("Content-Length")
-		body, retEncoding, err := encoding.EncodeWithSomething(site.Replace(entry.Content), r.Header.Get("Accept-Encoding"))
-		if err != nil {
-			logr.WithError(err).Error("Error encoding body")
-			http.Error(w, "Error encoding body", http.StatusInternalServerError)
+	upgrade := upgradeProtocol(r)
+	if upgrade != "" && !site.Upgrade.Allows(upgrade) {
+		// handled as a normal request, the upstream answers without upgrading
+		upgrade = ""
+	}
+
+	endCacheLookup := info.spans.start("cache_lookup")
+	entry, ok := site.ProbeCache(path, logr)
+	endCacheLookup()
+	if ok && upgrade == "" {
+		if s.rateLimited(w, site, clientIP, siteconfig.BudgetCache, logr) {
 			return
 		}
-		if retEncoding != "" {
-			w.Header().Set("Content-Encoding", retEncoding)
-		}
-		wasReplaced := len(body) != len(entry.Content) || bytes.Compare(body, entry.Content) != 0
-		if wasReplaced {
-			for _, header := range cacheRelatedHeaders {
-				delete(w.Header(), header)
+		logr.Info("Returning from cache")
+		info.cacheStatus = cacheStatusHit
+		s.serveFromCache(w, r, site, entry, info, logr)
+		return
+	}
+
+	info.cacheStatus = cacheStatusMiss
+	breaker := site.Breaker()
+	if !breaker.Allow() {
+		if entry, ok := site.ProbeStaleCache(path); ok && breaker.ServesStale() && upgrade == "" {
+			if s.rateLimited(w, site, clientIP, siteconfig.BudgetCache, logr) {
+				return
 			}
-			w.Header().Set("X-Replaced", "1")
-			w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Pragma", "no-cache")
+			logr.Warn("Circuit open, returning stale cache")
+			info.cacheStatus = cacheStatusStale
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+			s.serveFromCache(w, r, site, entry, info, logr)
+			return
 		}
-		w.WriteHeader(entry.Status)
-		_, _ = w.Write(body)
+		logr.Warn("Circuit open, failing fast")
+		w.Header().Set("Retry-After", strconv.Itoa(int(breaker.RetryAfter().Seconds())+1))
+		upstreamFailure(w, r, site, siteconfig.FailureUnavailable, "Upstream unavailable")
 		return
 	}
 
-	client := getHttpClient()
+	// -1 while no upstream attempt finished, 0 when the last attempt failed
+	// without a response
+	upstreamStatus := -1
+	defer func() {
+		switch {
+		case upstreamStatus == -1 || r.Context().Err() != nil:
+			breaker.Cancel()
+		case upstreamStatus == 0 || upstreamStatus > 499:
+			breaker.Failure()
+		default:
+			breaker.Success()
+		}
+	}()
 
-	if client == nil {
-		logr.Error("Error getting client")
-		http.Error(w, "Error getting client", http.StatusInternalServerError)
+	if s.rateLimited(w, site, clientIP, siteconfig.BudgetUpstream, logr) {
 		return
 	}
 
-	reqBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		logr.WithError(err).Error("Error reading body")
-		http.Error(w, "Error reading body", http.StatusInternalServerError)
+	proxyGroup := site.ProxyGroupFor(path)
+	if !s.pool.HasGroup(proxyGroup) {
+		logr.WithField("proxy_group", proxyGroup).Error("Unknown proxy group")
+		http.Error(w, "Unknown proxy group", http.StatusInternalServerError)
 		return
 	}
-
-	retryNum := -1
-
-retry:
-	retryNum++
-	if retryNum > 0 {
-		client = getHttpClient()
+	var sessionCookie *http.Cookie
+	pickProxy := func() *proxy_pool.Proxy {
+		return s.pool.GetProxyFromGroup(proxyGroup)
+	}
+	// stick assigns a sticky client to the proxy that served it
+	stick := func(*proxy_pool.Proxy) {}
+	if site.StickySession != nil {
+		var clientKey string
+		clientKey, sessionCookie = stickyClientKey(r, site.StickySession, clientIP)
+		pickProxy = func() *proxy_pool.Proxy {
+			return s.pool.GetStickyProxy(proxyGroup, clientKey, site.StickySession.TTL.Duration)
+		}
+		stick = func(proxy *proxy_pool.Proxy) {
+			s.pool.Stick(proxyGroup, clientKey, proxy, site.StickySession.TTL.Duration)
+		}
 	}
-	if retryNum > 3 {
-		logr.Error("Too many retries")
-		http.Error(w, "Failed to load", http.StatusInternalServerError)
+	proxy := pickProxy()
+
+	if proxy == nil {
+		logr.WithField("proxy_group", proxyGroup).Error("No healthy proxy available")
+		upstreamFailure(w, r, site, siteconfig.FailureUnavailable, "No healthy proxy available")
 		return
 	}
-	req, err := http.NewRequest(r.Method, site.URL(path), bytes.NewReader(reqBody))
-	if err != nil {
-		logr.WithError(err).Error("Error creating request")
-		http.Error(w, "Error creating request", http.StatusInternalServerError)
+
+	if upgrade != "" {
+		info.attempts++
+		info.proxies = append(info.proxies, proxy.Name())
+		if sessionCookie != nil {
+			http.SetCookie(w, sessionCookie)
+		}
+		upstreamStatus = s.proxyUpgrade(w, r, site, path, upgrade, proxy, logr)
+		if upstreamStatus > 0 && upstreamStatus < 500 {
+			stick(proxy)
+		}
 		return
 	}
 
-	for key, value := range r.Header {
-		if key == "Origin" || key == "Referer" || slices.Contains(stripHeaders, strings.ToLower(key)) {
-			continue
-		}
-		req.Header.Set(key, value[0])
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		logr.WithError(err).Error("Error reading body")
+		http.Error(w, "Error reading body", http.StatusInternalServerError)
+		return
 	}
 
-	req.Header.Set("Origin", strings.Replace(r.Header.Get("Origin"), r.Host, site.TargetHost, 1))
-	req.Header.Set("Referer", strings.Replace(r.Header.Get("Referer"), r.Host, site.TargetHost, 1))
+	policy := &site.Retry
+	maxAttempts := policy.Attempts(r.Method)
+	retryDeadline := startedAt.Add(policy.Budget.Duration)
 
-	if referrer := r.Header.Get("Referer"); referrer != "" {
-		referrer = strings.Replace(referrer, r.Host, site.TargetHost, 1)
-		req.Header.Set("Referer", referrer)
+	// waitRetry sleeps before the next attempt, it returns false when no
+	// attempts or budget are left, or the client went away
+	waitRetry := func() bool {
+		delay, ok := policy.NextRetry(info.attempts, maxAttempts, retryDeadline)
+		if !ok {
+			return false
+		}
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-time.After(delay):
+		}
+		proxy = pickProxy()
+		if proxy == nil {
+			logr.WithField("proxy_group", proxyGroup).Error("No healthy proxy available")
+			return false
+		}
+		return true
 	}
 
-	req.Header.Set("Host", site.TargetHost)
-	req.Header.Set("Connection", "keep-alive")
+	endUpstream := info.spans.start("upstream")
+	var resp *http.Response
+	for {
+		info.attempts++
+		info.proxies = append(info.proxies, proxy.Name())
 
-	for k, v := range site.ReqHeadersOverride {
-		req.Header.Set(k, v)
-	}
+		req, err := newUpstreamRequest(r, site, path, reqBody)
+		if err != nil {
+			logr.WithError(err).Error("Error creating request")
+			http.Error(w, "Error creating request", http.StatusInternalServerError)
+			return
+		}
 
-	logr.Infof("Incoming: [%s] %s %+v", r.Method, r.URL, r.Header)
-	logr.Infof("Outgoing: [%s] %s %+v", req.Method, req.URL.String(), req.Header)
+		logr.Infof("Incoming: [%s] %s %+v", r.Method, s.redactor.URL(r.URL.String()), s.redactor.Header(r.Header))
+		logr.Infof("Outgoing: [%s] %s %+v", req.Method, s.redactor.URL(req.URL.String()), s.redactor.Header(req.Header))
 
-	resp, err := client.Client.Do(req)
-	if err != nil {
-		logr.WithError(err).Error("Error getting page")
-		http.Error(w, "Error getting page", http.StatusInternalServerError)
-		return
-	}
-	if resp.StatusCode == 503 {
+		attemptStartedAt := time.Now()
+		resp, err = proxy.Do(req, site.UpstreamProtocol)
+		s.metrics.upstreamDuration.Observe(time.Since(attemptStartedAt).Seconds(), append(siteLabels(site), proxy.Name())...)
+		if err != nil {
+			errorClass := classifyError(err)
+			if proxyFailed(r, errorClass) {
+				proxy.ReportFailure(err)
+			}
+			logr.WithError(err).WithField("proxy", proxy.Name()).WithField("error_class", errorClass).Error("Error getting page")
+			if policy.RetriesError(errorClass) && waitRetry() {
+				continue
+			}
+			upstreamStatus = 0
+			upstreamFailure(w, r, site, siteconfig.FailureOf(errorClass), "Error getting page")
+			return
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			proxy.ReportFailure(errors.New(resp.Status))
+		} else {
+			proxy.ReportSuccess()
+		}
+		// a method that may not be retried gets the response as it is
+		if !policy.RetriesStatus(resp.StatusCode) || maxAttempts == 1 {
+			break
+		}
 		_ = resp.Body.Close()
-		logr.Warn("503, retrying")
-		goto retry
+		logr.WithField("proxy", proxy.Name()).Warnf("%d, retrying", resp.StatusCode)
+		if !waitRetry() {
+			upstreamStatus = resp.StatusCode
+			logr.Error("Too many retries")
+			upstreamFailure(w, r, site, siteconfig.FailureTooManyRetries, "Failed to load")
+			return
+		}
 	}
+	upstreamStatus = resp.StatusCode
 	defer resp.Body.Close()
+	if resp.StatusCode < 500 && resp.StatusCode != http.StatusProxyAuthRequired {
+		stick(proxy)
+	}
+	if site.IsStream(resp.Header.Get("Content-Type")) {
+		proxy_pool.KeepOpen(resp)
+		endUpstream()
+		if sessionCookie != nil {
+			http.SetCookie(w, sessionCookie)
+		}
+		s.streamResponse(w, r, resp, site, path, logr)
+		return
+	}
 	originalBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		logr.WithError(err).Error("Error reading body")
-		http.Error(w, "Error reading body", http.StatusInternalServerError)
+		upstreamFailure(w, r, site, siteconfig.FailureOf(classifyError(err)), "Error reading body")
 		return
 	}
+	endUpstream()
+	s.metrics.bytesReceived.Add(float64(len(originalBody)), siteLabels(site)...)
 
+	endDecode := info.spans.start("decode")
 	originalBody, err = encoding.Decode(originalBody, resp.Header.Get("Content-Encoding"))
+	endDecode()
 	if err != nil {
 		logr.WithError(err).Error("Error decoding body")
-		http.Error(w, "Error decoding body", http.StatusInternalServerError)
+		upstreamFailure(w, r, site, siteconfig.FailureDecode, "Error decoding body")
 		return
 	}
 	var newBody []byte
-	newBody = site.Replace(originalBody)
+	newBody = s.replace(site, originalBody, &info.spans)
 
 	wasReplaced := len(newBody) != len(originalBody) || bytes.Compare(newBody, originalBody) != 0
 
+	endEncode := info.spans.start("encode")
 	newBody, err = encoding.Encode(newBody, resp.Header.Get("Content-Encoding"))
+	endEncode()
 	if err != nil {
 		logr.WithError(err).Error("Error encoding body")
 		http.Error(w, "Error encoding body", http.StatusInternalServerError)
 		return
 	}
 
-	var headers = make(map[string]string)
-	for key, value := range resp.Header {
-		headers[key] = value[0]
-	}
-
-	shouldStripHeaders := true
-	for _, ext := range noStripHeadersFrom {
-		if strings.HasSuffix(path, ext) {
-			shouldStripHeaders = false
-			break
-		}
-	}
-	if shouldStripHeaders {
-		for _, header := range stripHeaders {
-			delete(headers, header)
-		}
-	}
-
-	for k, v := range site.RespHeadersOverride {
-		headers[k] = v
-	}
-
-	delete(headers, "Content-Length")
+	headers := responseHeaders(resp, site, path)
 
 	if resp.StatusCode > 399 {
-		logr.Warnf("Response: %d %+v", resp.StatusCode, headers)
+		logr.Warnf("Response: %d %+v", resp.StatusCode, s.redactor.Header(resp.Header))
+	}
+	if resp.StatusCode > 499 && site.HasErrorPage(siteconfig.FailureUpstream5xx) {
+		writeErrorPage(w, r, site, siteconfig.FailureUpstream5xx, resp.StatusCode)
+		return
 	}
 
 	if resp.StatusCode < 299 {
-		site.MbSaveToCache(path, originalBody, headers, resp.StatusCode)
+		site.MbSaveToCache(path, originalBody, headers, resp.StatusCode, logr)
 	}
 	for key, value := range headers {
 		w.Header().Set(key, value)
@@ -335,72 +545,106 @@ retry:
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Pragma", "no-cache")
 	}
+	if sessionCookie != nil {
+		http.SetCookie(w, sessionCookie)
+	}
 	w.WriteHeader(resp.StatusCode)
 	_, _ = w.Write(newBody)
 	return
 }
 
+// newHTTPServer returns the plain HTTP server, with h2c it also serves HTTP/2
+// to clients with prior knowledge.
+func newHTTPServer(handler http.Handler, h2c bool) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(h2c)
+	return &http.Server{
+		Handler:   handler,
+		Protocols: protocols,
+	}
+}
+
 func StartServer() {
-	httpClients = make([]*httpClientWithTtl, len(proxy_pool.GetAllProxies()))
-	for i, proxy := range proxy_pool.GetAllProxies() {
-		transport := &http.Transport{
-			MaxIdleConns:          20,
-			DisableCompression:    false,
-			IdleConnTimeout:       time.Second * 30,
-			TLSHandshakeTimeout:   time.Second * 5,
-			ResponseHeaderTimeout: time.Second * 40,
-		}
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error reading server config")
+	}
+	if err := setupLogging(cfg.Log); err != nil {
+		logrus.WithError(err).Fatal("Error setting up logging")
+	}
+	redactConfig := redact.DefaultConfig
+	if cfg.Redact != nil {
+		redactConfig = *cfg.Redact
+	}
+	// for the sites and the proxy pool, the server adds its own to its logger
+	logrus.AddHook(redact.Hook{Redactor: redact.New(redactConfig)})
+
+	lns, err := listeners.Inherit()
+	if err != nil {
+		logrus.WithError(err).Fatal("Error inheriting listeners")
+	}
+
+	s, err := New(Options{
+		ConfigDir:       cfg.ConfigDir,
+		ProxiesFile:     cfg.ProxiesFile,
+		ProxyPoolConfig: cfg.ProxyPoolConfig,
+		Upstream:        cfg.Upstream,
+		CacheTTL:        cfg.Cache.TTL.Duration,
+		AccessLog:       cfg.AccessLog,
+		Redact:          cfg.Redact,
+		TrustedProxies:  cfg.TrustedProxies,
+		IPFilter:        cfg.IPFilter,
+		UnknownHost:     cfg.UnknownHost,
+		DeactivatedHost: cfg.DeactivatedHost,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("Error starting server")
+	}
 
-		proxyUrl, err := url.Parse(proxy)
+	if cfg.Shutdown.CacheFile != "" {
+		entries, err := s.sites.LoadCaches(cfg.Shutdown.CacheFile)
 		if err != nil {
-			logrus.WithError(err).Error("Error parsing proxy")
-		}
-		transport.Proxy = http.ProxyURL(proxyUrl)
-
-		httpClients[i] = &httpClientWithTtl{
-			Client: &http.Client{
-				Transport: transport,
-				Timeout:   time.Second * 40,
-			},
-			LastUsedAt: time.Now(),
+			logrus.WithError(err).Error("Error loading page cache")
+		} else {
+			logrus.WithField("entries", entries).Info("Page cache loaded")
 		}
 	}
 
-	// check that there are no nil pointers
-	for _, client := range httpClients {
-		if client == nil {
-			logrus.Error("httpClients contains nil pointer")
-			return
-		}
-		if client.Client == nil {
-			logrus.Error("httpClients contains nil pointer")
-			return
-		}
-		if client.Client.Transport == nil {
-			logrus.Error("httpClients contains nil pointer")
-			return
-		}
+	s.Start(nil)
+
+	servers := make([]*http.Server, 0, 3)
+	admin := &http.Server{Handler: s.AdminHandler()}
+	if cfg.Admin.Listen == "" {
+		logrus.Info("Admin server disabled")
+	} else if ln, err := lns.Listen("admin", cfg.Admin.Listen); err != nil {
+		logrus.WithError(err).Error("Error starting admin server")
+	} else {
+		servers = append(servers, admin)
+		go serve("admin", ln, admin.Serve)
 	}
 
-	if len(httpClients) == 0 {
-		httpClients = append(httpClients, &httpClientWithTtl{
-			Client: &http.Client{
-				Timeout: time.Second * 40,
-				Transport: &http.Transport{
-					MaxIdleConns:          20,
-					DisableCompression:    false,
-					IdleConnTimeout:       time.Second * 30,
-					TLSHandshakeTimeout:   time.Second * 5,
-					ResponseHeaderTimeout: time.Second * 5,
-				},
-			},
+	var handler http.Handler = s
+	if cfg.TLS.Listen != "" {
+		server := s.newTLSServer(cfg.TLS, handler)
+		servers = append(servers, server)
+		go serve("https", listen(lns, "https", cfg.TLS.Listen), func(ln net.Listener) error {
+			return server.ServeTLS(ln, "", "")
 		})
+		if cfg.TLS.RedirectHTTP {
+			handler = redirectToHttps(cfg.TLS.Listen)
+		}
 	}
 
-	http.HandleFunc("/", HandleRequest)
-	logrus.Info("Starting server")
-	err := http.ListenAndServe(":6688", nil)
-	if err != nil {
-		logrus.WithError(err).Fatal("Error starting server")
+	server := newHTTPServer(handler, cfg.H2C)
+	servers = append(servers, server)
+	logrus.WithField("h2c", cfg.H2C).Info("Starting server")
+	go serve("http", listen(lns, "http", cfg.Listen), server.Serve)
+
+	lns.CloseUnused()
+	if err := lns.Ready(); err != nil {
+		logrus.WithError(err).Error("Error telling the previous process to shut down")
 	}
+	s.waitForShutdown(lns, cfg.Shutdown)
+	s.shutdown(servers, cfg.Shutdown)
 }
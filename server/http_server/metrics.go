@@ -0,0 +1,118 @@
+package http_server
+
+import (
+	"strconv"
+	"time"
+	"website_proxier/metrics"
+	"website_proxier/proxy_pool"
+	"website_proxier/siteconfig"
+)
+
+var proxyStates = []proxy_pool.State{proxy_pool.StateHealthy, proxy_pool.StateSuspect, proxy_pool.StateEjected, proxy_pool.StateDraining}
+
+// serverMetrics are the metrics of one Server.
+type serverMetrics struct {
+	registry         *metrics.Registry
+	requestsTotal    *metrics.CounterVec
+	upstreamDuration *metrics.HistogramVec
+	upstreamRetries  *metrics.CounterVec
+	replaceDuration  *metrics.HistogramVec
+	bytesReceived    *metrics.CounterVec
+	bytesSent        *metrics.CounterVec
+	rateLimited      *metrics.CounterVec
+}
+
+func newServerMetrics(sites *siteconfig.Registry, pool *proxy_pool.Pool) *serverMetrics {
+	registry := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: registry,
+		requestsTotal: registry.NewCounterVec("website_proxier_requests_total",
+			"Requests handled, by site, status and cache result.", "site", "host", "status", "cache"),
+		upstreamDuration: registry.NewHistogramVec("website_proxier_upstream_duration_seconds",
+			"Time until the upstream response headers arrived, per attempt.", metrics.DefaultBuckets, "site", "host", "proxy"),
+		upstreamRetries: registry.NewCounterVec("website_proxier_upstream_retries_total",
+			"Upstream attempts after the first one.", "site", "host"),
+		replaceDuration: registry.NewHistogramVec("website_proxier_replace_duration_seconds",
+			"Time spent applying replacements.", metrics.DefaultBuckets, "site", "host"),
+		bytesReceived: registry.NewCounterVec("website_proxier_upstream_bytes_received_total",
+			"Response body bytes received from upstreams, as sent on the wire.", "site", "host"),
+		bytesSent: registry.NewCounterVec("website_proxier_bytes_sent_total",
+			"Response body bytes sent to clients.", "site", "host"),
+		rateLimited: registry.NewCounterVec("website_proxier_rate_limited_total",
+			"Requests rejected by a rate or concurrency limit, by the limit hit.", "site", "host", "limit"),
+	}
+
+	registry.NewGaugeFunc("website_proxier_cache_entries", "Pages in the cache.", []string{"site", "host"},
+		func(emit func(float64, ...string)) {
+			for labels, stats := range cacheStats(sites) {
+				emit(float64(stats[0]), labels[0], labels[1])
+			}
+		})
+	registry.NewGaugeFunc("website_proxier_cache_size_bytes", "Size of the cached page contents.", []string{"site", "host"},
+		func(emit func(float64, ...string)) {
+			for labels, stats := range cacheStats(sites) {
+				emit(float64(stats[1]), labels[0], labels[1])
+			}
+		})
+	registry.NewGaugeFunc("website_proxier_proxy_state", "Proxy health state, 1 for the current state.", []string{"proxy", "state"},
+		func(emit func(float64, ...string)) {
+			for _, status := range pool.Statuses() {
+				for _, state := range proxyStates {
+					value := 0.0
+					if status.State == state {
+						value = 1
+					}
+					emit(value, status.Proxy, string(state))
+				}
+			}
+		})
+	registry.NewGaugeFunc("website_proxier_proxy_in_flight", "Requests in flight through the proxy.", []string{"proxy"},
+		func(emit func(float64, ...string)) {
+			for _, status := range pool.Statuses() {
+				emit(float64(status.InFlight), status.Proxy)
+			}
+		})
+	return m
+}
+
+// siteLabels returns the site and host labels of a website, websites resolved
+// from a host pattern are labeled with the pattern.
+func siteLabels(site *siteconfig.WebsiteConfig) []string {
+	if site == nil {
+		return []string{"unknown", "unknown"}
+	}
+	return []string{site.BaseConfig.Name, site.MetricsHost()}
+}
+
+// cacheStats returns the cached entries and bytes by site labels, summed over
+// the websites of a host pattern.
+func cacheStats(sites *siteconfig.Registry) map[[2]string][2]int {
+	stats := make(map[[2]string][2]int)
+	for _, site := range sites.GetAllSiteConfigs() {
+		entries, size := site.CacheStats()
+		labels := siteLabels(site)
+		key := [2]string{labels[0], labels[1]}
+		stats[key] = [2]int{stats[key][0] + entries, stats[key][1] + size}
+	}
+	return stats
+}
+
+func (m *serverMetrics) recordRequest(info *requestInfo, rec *responseRecorder) {
+	labels := siteLabels(info.site)
+	m.requestsTotal.Inc(labels[0], labels[1], strconv.Itoa(rec.status), info.cacheStatus)
+	m.bytesSent.Add(float64(rec.bytes), labels...)
+	if info.attempts > 1 {
+		m.upstreamRetries.Add(float64(info.attempts-1), labels...)
+	}
+}
+
+// replace applies the site replacements and records how long they took.
+func (s *Server) replace(site *siteconfig.WebsiteConfig, content []byte, spans *spans) []byte {
+	endReplace := spans.start("replace")
+	defer endReplace()
+
+	startedAt := time.Now()
+	replaced := site.Replace(content)
+	s.metrics.replaceDuration.Observe(time.Since(startedAt).Seconds(), siteLabels(site)...)
+	return replaced
+}
@@ -0,0 +1,51 @@
+package http_server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestHTTP2(t *testing.T) {
+	// the upstream answers with the HTTP version it was asked with
+	upstreamProto := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strconv.Itoa(r.ProtoMajor)))
+	})
+	tests := []struct {
+		name     string
+		protocol string
+		client   func(*http.Protocols)
+		proto    int
+		upstream string
+	}{
+		{"h2c to http2", "http2", func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) }, 2, "2"},
+		{"h2c to http1", "http1", func(p *http.Protocols) { p.SetUnencryptedHTTP2(true) }, 2, "1"},
+		{"http1 to auto", "auto", func(p *http.Protocols) { p.SetHTTP1(true) }, 1, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestUpstream(t, upstreamProto, `{"upstream_protocol": "`+tt.protocol+`"}`, true)
+			server := httptest.NewUnstartedServer(nil)
+			server.Config = newHTTPServer(s, true)
+			server.Start()
+			defer server.Close()
+
+			protocols := new(http.Protocols)
+			tt.client(protocols)
+			client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			req.Host = "mirror.test"
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.ProtoMajor != tt.proto || string(body) != tt.upstream {
+				t.Errorf("expected HTTP/%d from the server and HTTP/%s to the upstream, got HTTP/%d and HTTP/%s", tt.proto, tt.upstream, resp.ProtoMajor, body)
+			}
+		})
+	}
+}
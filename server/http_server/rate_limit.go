@@ -0,0 +1,33 @@
+package http_server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"website_proxier/siteconfig"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rateLimited answers 429 and returns true when the client or the site has no
+// budget left for the request.
+func (s *Server) rateLimited(w http.ResponseWriter, site *siteconfig.WebsiteConfig, clientIP string, budget siteconfig.Budget, logr *logrus.Entry) bool {
+	ok, perIP, retryAfter := site.RateLimiter().Allow(clientIP, budget)
+	if ok {
+		return false
+	}
+	limit := "site_" + string(budget)
+	if perIP {
+		limit = "ip_" + string(budget)
+	}
+	s.tooManyRequests(w, site, limit, retryAfter, logr)
+	return true
+}
+
+func (s *Server) tooManyRequests(w http.ResponseWriter, site *siteconfig.WebsiteConfig, limit string, retryAfter time.Duration, logr *logrus.Entry) {
+	s.metrics.rateLimited.Inc(append(siteLabels(site), limit)...)
+	logr.WithField("limit", limit).Warn("Rate limited")
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(retryAfter.Seconds())), 1)))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,229 @@
+package http_server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+	"website_proxier/accesslog"
+	"website_proxier/siteconfig"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cacheStatusNone  = "none"
+	cacheStatusHit   = "hit"
+	cacheStatusMiss  = "miss"
+	cacheStatusStale = "stale"
+)
+
+const requestIdHeader = "X-Request-ID"
+
+// requestInfo is filled in by handleRequest for the middleware that wraps it.
+type requestInfo struct {
+	id          string
+	log         *logrus.Entry // carries the request id
+	spans       spans
+	site        *siteconfig.WebsiteConfig
+	clientIP    netip.Addr // behind trusted proxies, the address they forwarded for
+	cacheStatus string
+	attempts    int
+	proxies     []string
+}
+
+type requestInfoKey struct{}
+
+func randomId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newRequestInfo(log *logrus.Logger, id string) *requestInfo {
+	return &requestInfo{
+		id:          id,
+		log:         log.WithField("request_id", id),
+		cacheStatus: cacheStatusNone,
+	}
+}
+
+func getRequestInfo(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return newRequestInfo(logrus.StandardLogger(), randomId())
+}
+
+// requestId returns the id sent by the client if it looks sane, a new one
+// otherwise.
+func requestId(r *http.Request) string {
+	id := r.Header.Get(requestIdHeader)
+	if id == "" || len(id) > 128 {
+		return randomId()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return randomId()
+		}
+	}
+	return id
+}
+
+// spans collects how long each stage of a request took.
+type spans struct {
+	names     []string
+	durations map[string]time.Duration
+}
+
+// start starts timing the named stage, the returned func stops it. A stage
+// that runs several times is summed up.
+func (s *spans) start(name string) func() {
+	startedAt := time.Now()
+	return func() {
+		if s.durations == nil {
+			s.durations = make(map[string]time.Duration)
+		}
+		if _, ok := s.durations[name]; !ok {
+			s.names = append(s.names, name)
+		}
+		s.durations[name] += time.Since(startedAt)
+	}
+}
+
+func (s *spans) logrusFields() logrus.Fields {
+	fields := make(logrus.Fields, len(s.names))
+	for _, name := range s.names {
+		fields["span_"+name] = s.durations[name].Round(time.Microsecond)
+	}
+	return fields
+}
+
+// responseRecorder remembers the status and the number of bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Hijack takes over the connection for an upgrade, the bytes written to it
+// still count towards the response size.
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buffered, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rec.status = http.StatusSwitchingProtocols
+	counted := &countingConn{Conn: conn, bytes: &rec.bytes}
+	buffered.Writer.Reset(counted)
+	return counted, buffered, nil
+}
+
+type countingConn struct {
+	net.Conn
+	bytes *int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	*c.bytes += int64(n)
+	return n, err
+}
+
+// instrument records metrics and writes the access log for every request
+// handled by next.
+func (s *Server) instrument(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startedAt := time.Now()
+		info := newRequestInfo(s.log, requestId(r))
+		info.clientIP = s.clientIP(r)
+		w.Header().Set(requestIdHeader, info.id)
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			// an aborted handler still counts, with the connection closed
+			// unless it had answered already
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					if rec.status == 0 {
+						rec.status = statusConnectionClosed
+					}
+					s.record(r, info, rec, startedAt)
+				}
+				panic(p)
+			}
+		}()
+		next(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.record(r, info, rec, startedAt)
+	}
+}
+
+func (s *Server) record(r *http.Request, info *requestInfo, rec *responseRecorder, startedAt time.Time) {
+	s.metrics.recordRequest(info, rec)
+	s.writeAccessLog(r, info, rec, startedAt)
+}
+
+func (s *Server) writeAccessLog(r *http.Request, info *requestInfo, rec *responseRecorder, startedAt time.Time) {
+	if s.accessLog == nil {
+		return
+	}
+	entry := accesslog.Entry{
+		Time:        startedAt,
+		RequestID:   info.id,
+		Host:        r.Host,
+		Method:      r.Method,
+		Path:        s.redactor.Path(r.URL.RequestURI()),
+		Proto:       r.Proto,
+		Status:      rec.status,
+		Bytes:       rec.bytes,
+		Duration:    time.Since(startedAt),
+		CacheStatus: info.cacheStatus,
+		Retries:     max(info.attempts-1, 0),
+		Referer:     s.redactor.URL(r.Referer()),
+		UserAgent:   r.UserAgent(),
+	}
+	if info.clientIP.IsValid() {
+		entry.ClientIP = info.clientIP.String()
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.ClientIP = host
+	} else {
+		entry.ClientIP = r.RemoteAddr
+	}
+	if info.site != nil {
+		entry.Site = info.site.BaseConfig.Name
+	}
+	if len(info.proxies) > 0 {
+		entry.Proxy = info.proxies[len(info.proxies)-1]
+	}
+	if err := s.accessLog.Log(entry); err != nil {
+		info.log.WithError(err).Error("Error writing access log")
+	}
+}
@@ -0,0 +1,55 @@
+package http_server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"website_proxier/siteconfig"
+)
+
+// proxyFailed tells whether an upstream error is the fault of the proxy and
+// counts against its health. Errors of the target and requests the client gave
+// up on say nothing about the proxy.
+func proxyFailed(r *http.Request, errorClass siteconfig.ErrorClass) bool {
+	return r.Context().Err() == nil && errorClass == siteconfig.ErrorClassProxy
+}
+
+// classifyError maps an upstream transport error to the error class used in
+// retry policies.
+func classifyError(err error) siteconfig.ErrorClass {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks")) {
+		return siteconfig.ErrorClassProxy
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return siteconfig.ErrorClassTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return siteconfig.ErrorClassDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return siteconfig.ErrorClassConnectionRefused
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return siteconfig.ErrorClassConnectionReset
+	}
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &recordErr) || errors.As(err, &certErr) || errors.As(err, &unknownAuthErr) || errors.As(err, &hostnameErr) {
+		return siteconfig.ErrorClassTLS
+	}
+	if strings.Contains(err.Error(), "proxyconnect") {
+		return siteconfig.ErrorClassProxy
+	}
+	return siteconfig.ErrorClassOther
+}
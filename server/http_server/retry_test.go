@@ -0,0 +1,205 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"website_proxier/siteconfig"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want siteconfig.ErrorClass
+	}{
+		{"deadline", context.DeadlineExceeded, siteconfig.ErrorClassTimeout},
+		{"wrapped deadline", fmt.Errorf("get: %w", context.DeadlineExceeded), siteconfig.ErrorClassTimeout},
+		{"dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, siteconfig.ErrorClassTimeout},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, siteconfig.ErrorClassConnectionRefused},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, siteconfig.ErrorClassConnectionReset},
+		{"eof", io.ErrUnexpectedEOF, siteconfig.ErrorClassConnectionReset},
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, siteconfig.ErrorClassDNS},
+		{"proxy connect", &net.OpError{Op: "proxyconnect", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, siteconfig.ErrorClassProxy},
+		{"other", errors.New("boom"), siteconfig.ErrorClassOther},
+	}
+	for _, test := range tests {
+		if got := classifyError(test.err); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// TestClassifyTransportError classifies the errors of real requests, as they
+// come out of the transport.
+func TestClassifyTransportError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	client := &http.Client{Timeout: time.Millisecond * 50}
+	_, err = client.Get("http://" + closedAddr)
+	if got := classifyError(err); got != siteconfig.ErrorClassConnectionRefused {
+		t.Errorf("closed port: got %s, want %s (%v)", got, siteconfig.ErrorClassConnectionRefused, err)
+	}
+	_, err = client.Get(slow.URL)
+	if got := classifyError(err); got != siteconfig.ErrorClassTimeout {
+		t.Errorf("slow upstream: got %s, want %s (%v)", got, siteconfig.ErrorClassTimeout, err)
+	}
+
+	// a 5xx is a response, not an error, retried by status and answered as a failure of its own
+	for class, status := range map[siteconfig.ErrorClass]int{
+		siteconfig.ErrorClassTimeout:           http.StatusGatewayTimeout,
+		siteconfig.ErrorClassConnectionRefused: http.StatusBadGateway,
+	} {
+		if got := siteconfig.FailureOf(class).Status(); got != status {
+			t.Errorf("%s: got status %d, want %d", class, got, status)
+		}
+	}
+}
+
+func TestRetryThroughServer(t *testing.T) {
+	var hits atomic.Int32
+	s, _ := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}), `{"no_cache": true, "retry": {"base_delay": "1ms", "max_delay": "1ms"}}`, false)
+
+	tests := []struct {
+		method string
+		hits   int32
+		status int
+	}{
+		{http.MethodGet, 4, http.StatusServiceUnavailable},
+		// gets the upstream answer as it is, never replayed
+		{http.MethodPost, 1, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		hits.Store(0)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(test.method, "http://mirror.test/", nil))
+		if hits.Load() != test.hits || rec.Code != test.status {
+			t.Errorf("%s: got %d upstream requests and %d, want %d and %d", test.method, hits.Load(), rec.Code, test.hits, test.status)
+		}
+	}
+}
+
+// connectProxy is an HTTP proxy that tunnels CONNECT requests, answering 502
+// when the target cannot be reached.
+func connectProxy(t *testing.T) string {
+	t.Helper()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, err := net.DialTimeout("tcp", r.Host, time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		client, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		_, _ = io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() { _, _ = io.Copy(target, client) }()
+		_, _ = io.Copy(client, target)
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy.Listener.Addr().String()
+}
+
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ln.Close()
+	return ln.Addr().String()
+}
+
+func TestProxyFailures(t *testing.T) {
+	// accepts connections and never answers
+	hanging, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hanging.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := hanging.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					_ = conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		proxy   string
+		target  string
+		cancel  bool
+		ejected bool
+	}{
+		{"target refuses", connectProxy(t), closedAddr(t), false, false},
+		{"client cancels", connectProxy(t), hanging.Addr().String(), true, false},
+		{"proxy refuses", closedAddr(t), closedAddr(t), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeSite(t, dir, "a", tt.target, "mirror.test", `{"no_cache": true, "retry": {"max_attempts": 1}}`)
+			proxiesFile := filepath.Join(dir, "proxies.txt")
+			if err := os.WriteFile(proxiesFile, []byte("http://"+tt.proxy+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := New(Options{ConfigDir: dir, ProxiesFile: proxiesFile})
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy := s.pool.GetAllProxies()[0]
+
+			for range 5 {
+				req := httptest.NewRequest(http.MethodGet, "http://mirror.test/", nil)
+				if tt.cancel {
+					ctx, cancel := context.WithTimeout(req.Context(), time.Millisecond*50)
+					defer cancel()
+					req = req.WithContext(ctx)
+				}
+				s.ServeHTTP(httptest.NewRecorder(), req)
+				if !proxy.Healthy() {
+					break
+				}
+			}
+			if got := !proxy.Healthy(); got != tt.ejected {
+				t.Errorf("expected ejected %v, got %v: %+v", tt.ejected, got, proxy.Status())
+			}
+		})
+	}
+}
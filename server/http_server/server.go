@@ -0,0 +1,209 @@
+package http_server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+	"website_proxier/accesslog"
+	"website_proxier/ipfilter"
+	"website_proxier/proxy_pool"
+	"website_proxier/redact"
+	"website_proxier/siteconfig"
+
+	"github.com/sirupsen/logrus"
+)
+
+const ipListWatchInterval = time.Second * 5
+
+// Options configure a Server.
+type Options struct {
+	ConfigDir       string // one directory per site
+	ProxiesFile     string // optional, like ProxyPoolConfig
+	ProxyPoolConfig string
+	Upstream        proxy_pool.TransportConfig
+	CacheTTL        time.Duration    // 2 hours when zero
+	AccessLog       accesslog.Config // off when the path is empty
+	Redact          *redact.Config   // redact.DefaultConfig when nil
+	TrustedProxies  []string         // CIDRs whose forwarding headers are believed, DefaultTrustedProxies when nil
+	IPFilter        *ipfilter.Config // applies to every site, on top of their own
+
+	UnknownHost     *siteconfig.HostResponse // siteconfig.DefaultUnknownHost when nil
+	DeactivatedHost *siteconfig.HostResponse // for deactivated sites without their own, UnknownHost when nil
+
+	// Logger is where the server logs, logrus.StandardLogger() when nil. The
+	// server logs through a copy with its redaction hook, its output, format
+	// and level are those of Logger when New is called. The sites and the
+	// proxy pool log through the standard logger, add a redact.Hook to it
+	// once per process.
+	Logger *logrus.Logger
+}
+
+// Server mirrors the sites of a config directory. Every Server has its own
+// sites, proxy pool, page cache and metrics, so several can run side by side.
+type Server struct {
+	sites     *siteconfig.Registry
+	pool      *proxy_pool.Pool
+	redactor  *redact.Redactor
+	accessLog *accesslog.Logger
+	metrics   *serverMetrics
+	handler   http.Handler
+	log       *logrus.Logger
+	upgrades  upgradedConns
+
+	trustedProxies []netip.Prefix
+	ipFilter       *ipfilter.Filter
+
+	unknownHost     *siteconfig.HostResponse
+	deactivatedHost *siteconfig.HostResponse
+}
+
+// New loads the sites and the proxies. Background work like health checks
+// only starts with Start.
+func New(opts Options) (*Server, error) {
+	s := &Server{
+		sites:    siteconfig.NewRegistry(opts.ConfigDir, opts.CacheTTL),
+		redactor: redact.New(redact.DefaultConfig),
+	}
+	if opts.Redact != nil {
+		s.redactor = redact.New(*opts.Redact)
+	}
+	s.log = redactedLogger(opts.Logger, s.redactor)
+
+	trustedProxies := opts.TrustedProxies
+	if trustedProxies == nil {
+		trustedProxies = DefaultTrustedProxies
+	}
+	var err error
+	s.trustedProxies, err = ipfilter.ParsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
+	if opts.IPFilter != nil {
+		s.ipFilter, err = ipfilter.New(*opts.IPFilter, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP filter: %w", err)
+		}
+	}
+
+	unknownHost := siteconfig.DefaultUnknownHost
+	if opts.UnknownHost != nil {
+		unknownHost = *opts.UnknownHost
+	}
+	if err := unknownHost.Prepare(""); err != nil {
+		return nil, fmt.Errorf("invalid unknown host response: %w", err)
+	}
+	s.unknownHost, s.deactivatedHost = &unknownHost, &unknownHost
+	if opts.DeactivatedHost != nil {
+		deactivatedHost := *opts.DeactivatedHost
+		if err := deactivatedHost.Prepare(""); err != nil {
+			return nil, fmt.Errorf("invalid deactivated host response: %w", err)
+		}
+		s.deactivatedHost = &deactivatedHost
+	}
+
+	if err := s.sites.LoadAllSites(); err != nil {
+		return nil, err
+	}
+
+	s.pool, err = proxy_pool.NewPoolFromFiles(opts.ProxiesFile, opts.ProxyPoolConfig, opts.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.AccessLog.Path != "" {
+		s.accessLog, err = accesslog.New(opts.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.metrics = newServerMetrics(s.sites, s.pool)
+	s.handler = s.instrument(s.handleRequest)
+	return s, nil
+}
+
+// redactedLogger returns a logger writing like base with the redaction hook of
+// the server in place of any of base. base itself is left alone, so servers
+// don't stack up hooks on it.
+func redactedLogger(base *logrus.Logger, redactor *redact.Redactor) *logrus.Logger {
+	if base == nil {
+		base = logrus.StandardLogger()
+	}
+	hooks := make(logrus.LevelHooks)
+	for level, levelHooks := range base.Hooks {
+		for _, hook := range levelHooks {
+			if _, ok := hook.(redact.Hook); !ok {
+				hooks[level] = append(hooks[level], hook)
+			}
+		}
+	}
+	hooks.Add(redact.Hook{Redactor: redactor})
+	return &logrus.Logger{
+		Out:          base.Out,
+		Formatter:    base.Formatter,
+		Hooks:        hooks,
+		Level:        base.GetLevel(),
+		ExitFunc:     base.ExitFunc,
+		ReportCaller: base.ReportCaller,
+	}
+}
+
+// Start runs the proxy health checks and the sticky session expiry, and
+// reloads the proxies and the IP lists when their files change, until stop is
+// closed.
+func (s *Server) Start(stop <-chan struct{}) {
+	s.pool.StartHealthChecks(stop)
+	s.pool.StartStickySweeps(stop)
+	s.pool.WatchFiles(stop)
+	go s.watchIPLists(stop)
+}
+
+func (s *Server) watchIPLists(stop <-chan struct{}) {
+	ticker := time.NewTicker(ipListWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := s.ipFilter.Reload(); err != nil {
+			s.log.WithError(err).Error("Error reloading IP lists")
+		}
+		// the websites of a host pattern share one filter
+		reloaded := make(map[*ipfilter.Filter]bool)
+		for _, site := range s.sites.GetAllSiteConfigs() {
+			if reloaded[site.Filter()] {
+				continue
+			}
+			reloaded[site.Filter()] = true
+			if err := site.Filter().Reload(); err != nil {
+				s.log.WithFields(site.LogrusFields()).WithError(err).Error("Error reloading IP lists")
+			}
+		}
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Sites returns the registry of the mirrored sites.
+func (s *Server) Sites() *siteconfig.Registry {
+	return s.sites
+}
+
+// Pool returns the proxy pool upstream requests go through.
+func (s *Server) Pool() *proxy_pool.Pool {
+	return s.pool
+}
+
+// Close closes the access log.
+func (s *Server) Close() error {
+	if s.accessLog == nil {
+		return nil
+	}
+	return s.accessLog.Close()
+}
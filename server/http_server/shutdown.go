@@ -0,0 +1,94 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"website_proxier/server/listeners"
+
+	"github.com/sirupsen/logrus"
+)
+
+func listen(lns *listeners.Set, name, addr string) net.Listener {
+	ln, err := lns.Listen(name, addr)
+	if err != nil {
+		logrus.WithError(err).WithField("listener", name).Fatal("Error starting server")
+	}
+	return ln
+}
+
+func serve(name string, ln net.Listener, serve func(net.Listener) error) {
+	logrus.WithField("listener", name).WithField("addr", ln.Addr().String()).Info("Listening")
+	err := serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.WithError(err).WithField("listener", name).Fatal("Error serving")
+	}
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT. SIGUSR2 starts a new process
+// of the binary with the listeners, that process sends SIGTERM once it serves.
+func (s *Server) waitForShutdown(lns *listeners.Set, cfg ShutdownConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	for sig := range signals {
+		if sig != syscall.SIGUSR2 {
+			s.log.WithField("signal", sig.String()).Info("Shutting down")
+			return
+		}
+		// the new process starts with the cache as it is now
+		s.saveCache(cfg)
+		process, err := lns.Handover()
+		if err != nil {
+			s.log.WithError(err).Error("Error handing over listeners")
+			continue
+		}
+		s.log.WithField("pid", process.Pid).Info("Listeners handed over")
+	}
+}
+
+// shutdown stops accepting connections and waits for in-flight requests and
+// upgraded connections until the shutdown timeout, then closes what is left.
+func (s *Server) shutdown(servers []*http.Server, cfg ShutdownConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				s.log.WithError(err).Warn("In-flight requests cut off")
+			}
+		}()
+	}
+	if closed := s.upgrades.drain(ctx); closed > 0 {
+		s.log.WithField("connections", closed).Warn("Upgraded connections cut off")
+	}
+	wg.Wait()
+
+	s.saveCache(cfg)
+	if err := s.Close(); err != nil {
+		s.log.WithError(err).Error("Error closing access log")
+	}
+	s.log.Info("Shut down")
+}
+
+func (s *Server) saveCache(cfg ShutdownConfig) {
+	if cfg.CacheFile == "" {
+		return
+	}
+	entries, err := s.sites.SaveCaches(cfg.CacheFile)
+	if err != nil {
+		s.log.WithError(err).Error("Error saving page cache")
+		return
+	}
+	s.log.WithField("entries", entries).Info("Page cache saved")
+}
@@ -0,0 +1,115 @@
+package http_server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"website_proxier/duration"
+)
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	s, err := New(Options{ConfigDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = io.WriteString(w, "done")
+	}))
+	server.Start()
+	defer server.Close()
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	shutDown := make(chan struct{})
+	go func() {
+		s.shutdown([]*http.Server{server.Config}, ShutdownConfig{Timeout: duration.Duration{Duration: time.Second * 5}})
+		close(shutDown)
+	}()
+	select {
+	case <-shutDown:
+		t.Fatal("shut down with a request in flight")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+	if got := <-results; got.err != nil || got.body != "done" {
+		t.Fatalf("in-flight request cut off: %q, %v", got.body, got.err)
+	}
+	select {
+	case <-shutDown:
+	case <-time.After(time.Second * 5):
+		t.Fatal("not shut down after the request finished")
+	}
+	if _, err := http.Get(server.URL); err == nil {
+		t.Error("new connections accepted after the shutdown")
+	}
+}
+
+func TestShutdownClosesUpgrades(t *testing.T) {
+	upstreamClosed := make(chan struct{}, 2)
+	s, _ := newTestUpstream(t, echoUpgrade(upstreamClosed), `{"upgrade": {"protocols": ["echo"]}}`, false)
+	server := httptest.NewServer(s)
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	shutdown := func() chan struct{} {
+		shutDown := make(chan struct{})
+		go func() {
+			s.shutdown([]*http.Server{server.Config}, ShutdownConfig{Timeout: duration.Duration{Duration: time.Millisecond * 300}})
+			close(shutDown)
+		}()
+		return shutDown
+	}
+
+	// an upgraded connection that closes in time is waited for
+	conn, _ := dialUpgrade(t, addr)
+	shutDown := shutdown()
+	time.Sleep(time.Millisecond * 50)
+	_, _ = io.WriteString(conn, "bye\n")
+	select {
+	case <-shutDown:
+	case <-time.After(time.Millisecond * 250):
+		t.Fatal("shutdown waited for the timeout with the upgraded connection closed")
+	}
+	<-upstreamClosed
+
+	// one that stays open is closed at the timeout
+	server = httptest.NewServer(s)
+	defer server.Close()
+	conn, reader := dialUpgrade(t, server.Listener.Addr().String())
+	startedAt := time.Now()
+	shutDown = shutdown()
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected the upgraded connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(startedAt); elapsed < time.Millisecond*250 {
+		t.Errorf("upgraded connection closed before the timeout, after %v", elapsed)
+	}
+	<-shutDown
+	select {
+	case <-upstreamClosed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("upstream of the upgraded connection not closed")
+	}
+	_ = conn.Close()
+}
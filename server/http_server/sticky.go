@@ -0,0 +1,41 @@
+package http_server
+
+import (
+	"net/http"
+	"strings"
+	"website_proxier/siteconfig"
+)
+
+// stickyClientKey identifies the client for sticky proxy selection. When the
+// client has no session cookie yet, the cookie to issue is returned as well.
+func stickyClientKey(r *http.Request, sticky *siteconfig.StickySession, clientIP string) (string, *http.Cookie) {
+	if sticky.By == siteconfig.StickyByCookie {
+		if cookie, err := r.Cookie(sticky.CookieName); err == nil && cookie.Value != "" {
+			return cookie.Value, nil
+		}
+		cookie := &http.Cookie{
+			Name:     sticky.CookieName,
+			Value:    randomId(),
+			Path:     "/",
+			MaxAge:   int(sticky.TTL.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		return cookie.Value, cookie
+	}
+
+	return clientIP, nil
+}
+
+// stripCookie removes the named cookie from a Cookie header value.
+func stripCookie(header string, name string) string {
+	cookies := strings.Split(header, ";")
+	kept := cookies[:0]
+	for _, cookie := range cookies {
+		if cookieName, _, _ := strings.Cut(strings.TrimSpace(cookie), "="); cookieName == name {
+			continue
+		}
+		kept = append(kept, strings.TrimSpace(cookie))
+	}
+	return strings.Join(kept, "; ")
+}
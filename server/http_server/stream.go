@@ -0,0 +1,78 @@
+package http_server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+	"website_proxier/encoding"
+	"website_proxier/siteconfig"
+
+	"github.com/sirupsen/logrus"
+)
+
+const streamBufferSize = 64 * 1024
+
+// streamResponse passes a streaming upstream response such as Server-Sent
+// Events on to the client as it arrives. Replacements are applied line by
+// line, so every event is rewritten before it is flushed. The response is sent
+// uncompressed and never cached.
+func (s *Server) streamResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, site *siteconfig.WebsiteConfig, path string, logr *logrus.Entry) {
+	body, err := encoding.NewDecodeReader(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		logr.WithError(err).Error("Error decoding body")
+		upstreamFailure(w, r, site, siteconfig.FailureDecode, "Error decoding body")
+		return
+	}
+	defer body.Close()
+
+	for key, value := range responseHeaders(resp, site, path) {
+		w.Header().Set(key, value)
+	}
+	w.Header().Del("Content-Encoding")
+	for _, header := range cacheRelatedHeaders {
+		delete(w.Header(), header)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(resp.StatusCode)
+
+	flusher := http.NewResponseController(w)
+	_ = flusher.Flush()
+
+	logr.Info("Streaming response")
+	startedAt := time.Now()
+	var received int64
+	reader := bufio.NewReaderSize(body, streamBufferSize)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			received += int64(len(line))
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				// lines longer than the buffer come in pieces that are passed on as they are
+				line = site.Replace(line)
+			}
+			if _, err := w.Write(line); err != nil {
+				logr.WithError(err).Info("Client went away while streaming")
+				break
+			}
+		}
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			if !errors.Is(err, io.EOF) {
+				logr.WithError(err).Warn("Error reading stream")
+			}
+			_ = flusher.Flush()
+			break
+		}
+		// flush once everything that arrived so far is written
+		if reader.Buffered() == 0 {
+			if err := flusher.Flush(); err != nil {
+				logr.WithError(err).Info("Client went away while streaming")
+				break
+			}
+		}
+	}
+	s.metrics.bytesReceived.Add(float64(received), siteLabels(site)...)
+	logr.WithField("duration", time.Since(startedAt).Round(time.Millisecond)).WithField("bytes", received).Info("Stream finished")
+}
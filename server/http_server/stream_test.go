@@ -0,0 +1,100 @@
+package http_server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// flushRecorder hands out the body written so far on every flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan string
+}
+
+func (r *flushRecorder) Flush() {
+	r.ResponseRecorder.Flush()
+	select {
+	case r.flushed <- r.Body.String():
+	default:
+	}
+}
+
+func TestStreamResponse(t *testing.T) {
+	dir := t.TempDir()
+	writeSite(t, dir, "a", "example.com", "mirror.test", `{"replacements": [{"from": "example.com", "to": "mirror.test"}]}`)
+	s, err := New(Options{ConfigDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	site, _ := s.sites.GetSiteConfig("mirror.test")
+	req := httptest.NewRequest(http.MethodGet, "http://mirror.test/events", nil)
+	logr := logrus.NewEntry(logrus.StandardLogger())
+
+	t.Run("chunks", func(t *testing.T) {
+		body, upstream := io.Pipe()
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/event-stream"}}, Body: body}
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan string, 1)}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.streamResponse(rec, req, resp, site, "/events", logr)
+		}()
+
+		waitFlush := func(want string) {
+			t.Helper()
+			deadline := time.After(time.Second * 5)
+			for {
+				select {
+				case got := <-rec.flushed:
+					if got == want {
+						return
+					}
+				case <-deadline:
+					t.Fatalf("expected %q to be flushed", want)
+				}
+			}
+		}
+
+		// a match split over two writes of the upstream is still replaced
+		_, _ = io.WriteString(upstream, "data: https://exam")
+		_, _ = io.WriteString(upstream, "ple.com/a\n\n")
+		waitFlush("data: https://mirror.test/a\n\n")
+		// the last line without a newline is passed on at the end
+		_, _ = io.WriteString(upstream, "data: example.com")
+		_ = upstream.Close()
+		<-done
+		if got, want := rec.Body.String(), "data: https://mirror.test/a\n\ndata: mirror.test"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if rec.Header().Get("Cache-Control") != "no-cache" {
+			t.Errorf("expected a stream not to be cached, got %q", rec.Header().Get("Cache-Control"))
+		}
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		_, _ = io.WriteString(gz, "data: example.com\n\n")
+		_ = gz.Close()
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/event-stream"}, "Content-Encoding": {"gzip"}},
+			Body:       io.NopCloser(&compressed),
+		}
+		rec := httptest.NewRecorder()
+		s.streamResponse(rec, req, resp, site, "/events", logr)
+		if got := rec.Body.String(); got != "data: mirror.test\n\n" {
+			t.Errorf("expected the decoded and replaced stream, got %q", got)
+		}
+		if rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("expected the stream to be sent uncompressed, got %q", rec.Header().Get("Content-Encoding"))
+		}
+	})
+}
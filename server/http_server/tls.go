@@ -0,0 +1,55 @@
+package http_server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"website_proxier/server/certstore"
+)
+
+func (s *Server) mirrorHosts() []string {
+	sites := s.sites.GetAllSiteConfigs()
+	hosts := make([]string, 0, len(sites))
+	for _, site := range sites {
+		hosts = append(hosts, site.MirrorHost())
+	}
+	return hosts
+}
+
+// redirectToHttps redirects every request to the same URL on the HTTPS
+// listener.
+func redirectToHttps(httpsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}
+}
+
+func (s *Server) newTLSServer(cfg TLSConfig, handler http.Handler) *http.Server {
+	store, err := certstore.New(cfg.CertDir, cfg.SelfSigned, s.mirrorHosts, s.sites.Serves)
+	if err != nil {
+		// keep going with the pairs that loaded
+		s.log.WithError(err).Error("Error loading certificates")
+	}
+	store.Watch(nil)
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	server := &http.Server{
+		Handler:   handler,
+		Protocols: protocols,
+		TLSConfig: &tls.Config{
+			GetCertificate: store.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+	return server
+}
@@ -0,0 +1,218 @@
+package http_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"website_proxier/proxy_pool"
+	"website_proxier/siteconfig"
+
+	"github.com/sirupsen/logrus"
+)
+
+// upgradeProtocol returns the protocol an HTTP/1.1 request asks to upgrade to,
+// or an empty string for a normal request.
+func upgradeProtocol(r *http.Request) string {
+	if r.ProtoMajor != 1 {
+		return ""
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return r.Header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// proxyUpgrade dials the upgrade upstream through proxy and splices it with the
+// client connection until either side closes or the connection goes idle. It
+// returns the upstream status, 0 when the upstream could not be reached.
+func (s *Server) proxyUpgrade(w http.ResponseWriter, r *http.Request, site *siteconfig.WebsiteConfig, path string, protocol string, proxy *proxy_pool.Proxy, logr *logrus.Entry) int {
+	req, err := newUpstreamRequest(r, site, path, nil)
+	if err != nil {
+		logr.WithError(err).Error("Error creating request")
+		http.Error(w, "Error creating request", http.StatusInternalServerError)
+		return -1
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+
+	resp, upstream, err := proxy.Upgrade(req)
+	if err != nil {
+		errorClass := classifyError(err)
+		if proxyFailed(r, errorClass) {
+			proxy.ReportFailure(err)
+		}
+		logr.WithError(err).WithField("proxy", proxy.Name()).WithField("error_class", errorClass).Error("Error upgrading connection")
+		upstreamFailure(w, r, site, siteconfig.FailureOf(errorClass), "Error upgrading connection")
+		return 0
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		proxy.ReportFailure(errors.New(resp.Status))
+	} else {
+		proxy.ReportSuccess()
+	}
+
+	if upstream == nil {
+		// the upstream refused to switch, pass its answer on
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return resp.StatusCode
+	}
+	defer upstream.Close()
+
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logr.WithError(err).Error("Error hijacking connection")
+		http.Error(w, "Upgrade not supported", http.StatusInternalServerError)
+		return resp.StatusCode
+	}
+	defer client.Close()
+	defer s.upgrades.add(client)()
+
+	_, _ = fmt.Fprintf(buffered, "HTTP/1.1 %s\r\n", resp.Status)
+	_ = resp.Header.Write(buffered)
+	_, _ = buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		logr.WithError(err).Error("Error writing upgrade response")
+		return resp.StatusCode
+	}
+
+	logr.WithField("upgrade", protocol).WithField("proxy", proxy.Name()).Info("Connection upgraded")
+	startedAt := time.Now()
+	toClient, toUpstream := splice(client, buffered.Reader, upstream, site.Upgrade.IdleTimeout.Duration)
+	logr.WithFields(logrus.Fields{
+		"upgrade":         protocol,
+		"duration":        time.Since(startedAt).Round(time.Millisecond),
+		"bytes_to_client": toClient,
+		"bytes_upstream":  toUpstream,
+	}).Info("Upgraded connection closed")
+	return resp.StatusCode
+}
+
+// upgradedConns are the client connections of upgrades in progress. Hijacked
+// connections are out of sight of http.Server.Shutdown, they are drained here.
+type upgradedConns struct {
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+	drained chan struct{} // closed when the last connection is done
+}
+
+// add tracks conn until the returned func is called. Connections added after
+// the drain timed out are closed right away.
+func (u *upgradedConns) add(conn net.Conn) (done func()) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		_ = conn.Close()
+	}
+	if u.conns == nil {
+		u.conns = make(map[net.Conn]struct{})
+	}
+	u.conns[conn] = struct{}{}
+	return sync.OnceFunc(func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		delete(u.conns, conn)
+		if len(u.conns) == 0 && u.drained != nil {
+			close(u.drained)
+			u.drained = nil
+		}
+	})
+}
+
+// drain waits for the upgraded connections to close until ctx is done, then
+// closes the rest. It returns how many it closed.
+func (u *upgradedConns) drain(ctx context.Context) int {
+	u.mu.Lock()
+	if len(u.conns) == 0 {
+		u.mu.Unlock()
+		return 0
+	}
+	drained := make(chan struct{})
+	u.drained = drained
+	u.mu.Unlock()
+
+	select {
+	case <-drained:
+		return 0
+	case <-ctx.Done():
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	for conn := range u.conns {
+		_ = conn.Close()
+	}
+	return len(u.conns)
+}
+
+// activityReader records the time of every read that returned data.
+type activityReader struct {
+	io.Reader
+	last *atomic.Int64
+}
+
+func (r activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// splice copies data both ways between the client and the upstream. Both are
+// closed once either side closes, or after no data moved in either direction
+// for idleTimeout.
+func splice(client net.Conn, clientReader io.Reader, upstream io.ReadWriteCloser, idleTimeout time.Duration) (toClient, toUpstream int64) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	closeBoth := sync.OnceFunc(func() {
+		_ = client.Close()
+		_ = upstream.Close()
+	})
+
+	var mu sync.Mutex
+	var idleTimer *time.Timer
+	mu.Lock()
+	idleTimer = time.AfterFunc(idleTimeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if idle := time.Since(time.Unix(0, last.Load())); idle < idleTimeout {
+			idleTimer.Reset(idleTimeout - idle)
+			return
+		}
+		closeBoth()
+	})
+	mu.Unlock()
+	defer idleTimer.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		toUpstream, _ = io.Copy(upstream, activityReader{Reader: clientReader, last: &last})
+	}()
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		toClient, _ = io.Copy(client, activityReader{Reader: upstream, last: &last})
+	}()
+	wg.Wait()
+	return toClient, toUpstream
+}
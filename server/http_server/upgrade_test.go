@@ -0,0 +1,105 @@
+package http_server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoUpgrade switches to a protocol that echoes every line, and closes after
+// a "bye" line.
+func echoUpgrade(closed chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+			closed <- struct{}{}
+		}()
+		_, _ = buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = buffered.Flush()
+		for {
+			line, err := buffered.ReadString('\n')
+			if err != nil || line == "bye\n" {
+				return
+			}
+			_, _ = buffered.WriteString("echo " + line)
+			_ = buffered.Flush()
+		}
+	}
+}
+
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: mirror.test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	return conn, reader
+}
+
+func TestUpgrade(t *testing.T) {
+	upstreamClosed := make(chan struct{}, 2)
+	s, _ := newTestUpstream(t, echoUpgrade(upstreamClosed), `{"upgrade": {"protocols": ["echo"]}}`, false)
+	server := httptest.NewServer(s)
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	// data goes both ways
+	conn, reader := dialUpgrade(t, addr)
+	for _, line := range []string{"hello\n", "world\n"} {
+		_, _ = io.WriteString(conn, line)
+		got, err := reader.ReadString('\n')
+		if err != nil || got != "echo "+line {
+			t.Fatalf("expected %q echoed, got %q, %v", line, got, err)
+		}
+	}
+
+	// the client closing closes the upstream
+	_ = conn.Close()
+	select {
+	case <-upstreamClosed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("upstream not closed after the client closed")
+	}
+
+	// the upstream closing closes the client
+	conn, reader = dialUpgrade(t, addr)
+	_, _ = io.WriteString(conn, "bye\n")
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected the client connection to be closed, got %v", err)
+	}
+	<-upstreamClosed
+
+	// without the upgrade allowed the upstream answers a normal request
+	s, _ = newTestUpstream(t, echoUpgrade(upstreamClosed), `{}`, false)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://mirror.test/socket", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUpgradeRequired {
+		t.Errorf("expected the upgrade to be dropped, got %d", rec.Code)
+	}
+}
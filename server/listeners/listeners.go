@@ -0,0 +1,189 @@
+// Package listeners passes listening sockets from one process to the next, so
+// a new binary can take over without refusing connections. Sockets are
+// inherited either from a parent that called Handover or from systemd socket
+// activation.
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	firstFd   = 3 // SD_LISTEN_FDS_START, ExtraFiles start there as well
+	namesEnv  = "WEBSITE_PROXIER_LISTENERS"
+	parentEnv = "WEBSITE_PROXIER_PARENT"
+)
+
+var systemdEnv = []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"}
+
+// Set keeps track of the listeners of the process by name.
+type Set struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	names     []string
+	active    map[string]net.Listener
+	parent    int // the process that handed the listeners over, 0 when there was none
+}
+
+// Inherit picks up the listeners passed to this process. Systemd names them
+// with FileDescriptorName=, without names they are called "unknown".
+func Inherit() (*Set, error) {
+	s := &Set{
+		inherited: make(map[string]*os.File),
+		active:    make(map[string]net.Listener),
+	}
+
+	var names []string
+	if list := os.Getenv(namesEnv); list != "" {
+		names = strings.Split(list, ",")
+		s.parent, _ = strconv.Atoi(os.Getenv(parentEnv))
+	} else if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			return s, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+		}
+		names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for len(names) < count {
+			names = append(names, "unknown")
+		}
+		names = names[:count]
+	}
+	// children get the listeners from Handover, not from the environment
+	for _, key := range append(systemdEnv, namesEnv, parentEnv) {
+		_ = os.Unsetenv(key)
+	}
+
+	for i, name := range names {
+		fd := firstFd + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		if _, ok := s.inherited[name]; ok {
+			// only the first one can be asked for, systemd calls all the
+			// unnamed ones "unknown"
+			_ = f.Close()
+			continue
+		}
+		s.inherited[name] = f
+	}
+	return s, nil
+}
+
+// Listen returns the listener called name, the inherited one when there is
+// one, otherwise a new one on addr.
+func (s *Set) Listen(name, addr string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ln net.Listener
+	var err error
+	if f, ok := s.inherited[name]; ok {
+		delete(s.inherited, name)
+		ln, err = net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error using inherited listener %s: %w", name, err)
+		}
+	} else {
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := s.active[name]; !ok {
+		s.names = append(s.names, name)
+	}
+	s.active[name] = ln
+	return ln, nil
+}
+
+// CloseUnused closes inherited listeners that were not asked for, their
+// connections would otherwise wait forever.
+func (s *Set) CloseUnused() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, f := range s.inherited {
+		_ = f.Close()
+		delete(s.inherited, name)
+	}
+}
+
+// Inherited reports whether the listeners were handed over by a parent.
+func (s *Set) Inherited() bool {
+	return s.parent != 0
+}
+
+// Ready tells the process that handed the listeners over that this one is
+// serving, so it shuts down.
+func (s *Set) Ready() error {
+	if s.parent == 0 {
+		return nil
+	}
+	parent, err := os.FindProcess(s.parent)
+	if err != nil {
+		return err
+	}
+	return parent.Signal(syscall.SIGTERM)
+}
+
+// Handover starts the current binary again with the active listeners. Both
+// processes accept connections until the new one calls Ready.
+func (s *Set) Handover() (*os.Process, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(s.names))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, name := range s.names {
+		filer, ok := s.active[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener %s cannot be handed over", name)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return nil, fmt.Errorf("error handing over listener %s: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no listeners to hand over")
+	}
+
+	env := slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		key, _, _ := strings.Cut(kv, "=")
+		return slices.Contains(systemdEnv, key)
+	})
+	env = append(env,
+		namesEnv+"="+strings.Join(s.names, ","),
+		parentEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
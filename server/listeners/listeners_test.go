@@ -0,0 +1,163 @@
+package listeners
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const helperEnv = "LISTENERS_TEST_HELPER"
+
+// TestHelperProcess is the child of the inherit tests, it reports what it
+// inherited on stdout and exits once stdin closes.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv(helperEnv) == "" {
+		t.Skip("run by the other tests")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	}
+	s, err := Inherit()
+	if err != nil {
+		fmt.Println("error", err)
+		os.Exit(1)
+	}
+	names := make([]string, 0, len(s.inherited))
+	for name := range s.inherited {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	fmt.Println("inherited", strings.Join(names, ","), s.Inherited())
+
+	ln, err := s.Listen("http", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("error", err)
+		os.Exit(1)
+	}
+	fmt.Println("http", ln.Addr())
+	s.CloseUnused()
+	fmt.Println("closed")
+	_, _ = io.Copy(io.Discard, os.Stdin)
+	os.Exit(0)
+}
+
+// startChild passes n listeners to a child process with env, it returns their
+// addresses and the lines the child printed up to "closed".
+func startChild(t *testing.T, n int, env ...string) ([]string, []string) {
+	t.Helper()
+	var addrs []string
+	var files []*os.File
+	for range n {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, ln.Addr().String())
+		files = append(files, f)
+		// the child holds the only copy
+		_ = ln.Close()
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), append(env, helperEnv+"=1")...)
+	cmd.ExtraFiles = files
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		_ = f.Close()
+	}
+	t.Cleanup(func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	})
+
+	var lines []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() && scanner.Text() != "closed" {
+		lines = append(lines, scanner.Text())
+	}
+	return addrs, lines
+}
+
+func refused(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return true
+	}
+	_ = conn.Close()
+	return false
+}
+
+func TestInheritSystemd(t *testing.T) {
+	// three sockets, one name: the others are "unknown", and only the first
+	// of those can be asked for
+	addrs, lines := startChild(t, 3, "LISTEN_FDS=3", "LISTEN_FDNAMES=http")
+	want := []string{"inherited http,unknown false", "http " + addrs[0]}
+	if !slices.Equal(lines, want) {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+	if refused(addrs[0]) {
+		t.Error("inherited listener in use refused a connection")
+	}
+	for _, addr := range addrs[1:] {
+		if !refused(addr) {
+			t.Errorf("unused listener %s not closed", addr)
+		}
+	}
+}
+
+func TestInheritNamesPadding(t *testing.T) {
+	// more names than sockets are cut off
+	addrs, lines := startChild(t, 1, "LISTEN_FDS=1", "LISTEN_FDNAMES=http:admin")
+	want := []string{"inherited http false", "http " + addrs[0]}
+	if !slices.Equal(lines, want) {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+}
+
+func TestInheritHandover(t *testing.T) {
+	addrs, lines := startChild(t, 2, namesEnv+"=admin,http", parentEnv+"=1")
+	want := []string{"inherited admin,http true", "http " + addrs[1]}
+	if !slices.Equal(lines, want) {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+	if !refused(addrs[0]) {
+		t.Error("unused listener not closed")
+	}
+}
+
+func TestListenWithoutInherited(t *testing.T) {
+	s, err := Inherit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := s.Listen("http", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if s.Inherited() || s.names[0] != "http" {
+		t.Errorf("expected a new listener, got %v %v", s.Inherited(), s.names)
+	}
+}
@@ -0,0 +1,222 @@
+package siteconfig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"website_proxier/duration"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type AuthMode string
+
+const (
+	AuthBasic AuthMode = "basic" // HTTP Basic authentication
+	AuthLogin AuthMode = "login" // a login page that sets a signed cookie
+)
+
+// verifiedTTL is how long a checked password is remembered, bcrypt is too
+// slow to run on every request of a page.
+const verifiedTTL = time.Minute * 5
+
+// AuthConfig password-protects a website. Credentials are never forwarded to
+// the upstream.
+type AuthConfig struct {
+	Mode         AuthMode          `json:"mode"`         // basic or login, basic when empty
+	Realm        string            `json:"realm"`        // shown by browsers for basic
+	Users        map[string]string `json:"users"`        // user name -> bcrypt hash
+	ExemptPaths  []string          `json:"exempt_paths"` // reachable without credentials, a trailing * matches a prefix
+	LoginPath    string            `json:"login_path"`
+	CookieName   string            `json:"cookie_name"`
+	CookieTTL    duration.Duration `json:"cookie_ttl"`
+	Secret       string            `json:"secret"`        // signs login cookies, a key of the process when empty so logins end with a restart
+	FailedLogins RateLimit         `json:"failed_logins"` // wrong passwords per client, one every 10 seconds with a burst of 10 when unset
+
+	secret []byte
+	// checked for unknown users, so they take as long as wrong passwords
+	dummyHash []byte
+
+	verifiedMu sync.Mutex
+	verified   map[[sha256.Size]byte]time.Time
+
+	failedMu       sync.Mutex
+	failed         map[string]*tokenBucket
+	failedPrunedAt time.Time
+}
+
+func (c *AuthConfig) setDefaults() {
+	if c.Mode == "" {
+		c.Mode = AuthBasic
+	}
+	if c.Realm == "" {
+		c.Realm = "Restricted"
+	}
+	if c.LoginPath == "" {
+		c.LoginPath = "/__wp_login"
+	}
+	if c.CookieName == "" {
+		c.CookieName = "__wp_auth"
+	}
+	c.CookieTTL.Duration = c.CookieTTL.Or(time.Hour * 24)
+	if c.FailedLogins.Rate == 0 {
+		c.FailedLogins = RateLimit{Rate: 0.1, Burst: 10}
+	}
+	c.FailedLogins.setDefaults()
+	c.secret = []byte(c.Secret)
+	for _, hash := range c.Users {
+		c.dummyHash = []byte(hash)
+		break
+	}
+	c.verified = make(map[[sha256.Size]byte]time.Time)
+	c.failed = make(map[string]*tokenBucket)
+}
+
+func (c *AuthConfig) validate() error {
+	if c.Mode != AuthBasic && c.Mode != AuthLogin {
+		return fmt.Errorf("unknown auth mode: %s", c.Mode)
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("no users")
+	}
+	if c.FailedLogins.Rate < 0 {
+		return fmt.Errorf("negative failed_logins rate: %v", c.FailedLogins.Rate)
+	}
+	for user, hash := range c.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash of %s: %w", user, err)
+		}
+	}
+	return nil
+}
+
+// Exempt reports whether path can be requested without credentials. The path
+// is cleaned first, dot segments must not lead out of an exempt prefix.
+func (c *AuthConfig) Exempt(path string) bool {
+	path = CleanPath(path)
+	for _, exempt := range c.ExemptPaths {
+		if prefix, ok := strings.CutSuffix(exempt, "*"); ok && strings.HasPrefix(path, prefix) || path == exempt {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckPassword reports whether the password of user is right.
+func (c *AuthConfig) CheckPassword(user, password string) bool {
+	hash, ok := c.Users[user]
+	if !ok {
+		// as slow as a wrong password, or the time taken tells which users exist
+		_ = bcrypt.CompareHashAndPassword(c.dummyHash, []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+
+	c.verifiedMu.Lock()
+	verifiedAt, ok := c.verified[key]
+	c.verifiedMu.Unlock()
+	if ok && time.Since(verifiedAt) < verifiedTTL {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	c.verifiedMu.Lock()
+	defer c.verifiedMu.Unlock()
+	for k, at := range c.verified {
+		if time.Since(at) >= verifiedTTL {
+			delete(c.verified, k)
+		}
+	}
+	c.verified[key] = time.Now()
+	return true
+}
+
+// LoginAllowed reports whether client may try a password now. When it has
+// used up its failed logins, it also returns how long until it may again.
+func (c *AuthConfig) LoginAllowed(client string) (bool, time.Duration) {
+	c.failedMu.Lock()
+	defer c.failedMu.Unlock()
+	bucket, ok := c.failed[client]
+	if !ok {
+		return true, 0
+	}
+	wait := bucket.wait(c.FailedLogins, time.Now())
+	return wait == 0, wait
+}
+
+// LoginFailed counts a wrong password of client against its failed logins.
+func (c *AuthConfig) LoginFailed(client string) {
+	c.failedMu.Lock()
+	defer c.failedMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.failedPrunedAt) > time.Minute {
+		// clients whose buckets have filled up again are as good as new
+		refill := time.Duration(float64(c.FailedLogins.Burst) / c.FailedLogins.Rate * float64(time.Second))
+		for key, bucket := range c.failed {
+			if now.Sub(bucket.updatedAt) > refill {
+				delete(c.failed, key)
+			}
+		}
+		c.failedPrunedAt = now
+	}
+	bucket, ok := c.failed[client]
+	if !ok {
+		bucket = &tokenBucket{}
+		c.failed[client] = bucket
+	}
+	bucket.wait(c.FailedLogins, now)
+	bucket.take(c.FailedLogins)
+}
+
+// sessionKey is the key signing the login cookies of a website without a
+// secret. It is derived from a key of the registry, so logins survive config
+// reloads, and differs per website, so a cookie of one doesn't let in to
+// another.
+func (r *Registry) sessionKey(site, mirror string) []byte {
+	mac := hmac.New(sha256.New, r.sessionSecret)
+	mac.Write([]byte(site + "\x00" + mirror))
+	return mac.Sum(nil)
+}
+
+func (c *AuthConfig) sign(payload string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SessionCookie returns the signed value of a login cookie for user.
+func (c *AuthConfig) SessionCookie(user string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user + "\x00" + strconv.FormatInt(time.Now().Add(c.CookieTTL.Duration).Unix(), 10)))
+	return payload + "." + c.sign(payload)
+}
+
+// VerifySessionCookie reports whether a login cookie value is signed by us,
+// not expired and of a user that still exists.
+func (c *AuthConfig) VerifySessionCookie(value string) bool {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(c.sign(payload))) {
+		return false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	user, expires, ok := strings.Cut(string(decoded), "\x00")
+	if !ok {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	_, ok = c.Users[user]
+	return ok
+}
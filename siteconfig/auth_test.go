@@ -0,0 +1,134 @@
+package siteconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &AuthConfig{Mode: AuthLogin, Users: map[string]string{"alice": string(hash)}, ExemptPaths: []string{"/robots.txt", "/static/*"}, Secret: "key"}
+	auth.setDefaults()
+	if err := auth.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !auth.CheckPassword("alice", "secret") {
+		t.Error("right password rejected")
+	}
+	if len(auth.verified) != 1 {
+		t.Fatalf("expected the checked password to be remembered, got %d", len(auth.verified))
+	}
+	// remembered, answered without bcrypt even with the hash gone bad
+	auth.Users["alice"] = "invalid"
+	if !auth.CheckPassword("alice", "secret") {
+		t.Error("remembered password rejected")
+	}
+	auth.Users["alice"] = string(hash)
+	if auth.CheckPassword("alice", "wrong") || auth.CheckPassword("bob", "secret") {
+		t.Error("wrong credentials accepted")
+	}
+
+	cookie := auth.SessionCookie("alice")
+	if !auth.VerifySessionCookie(cookie) {
+		t.Error("own cookie rejected")
+	}
+	if auth.VerifySessionCookie(cookie[:len(cookie)-1]+"x") || auth.VerifySessionCookie("") {
+		t.Error("forged cookie accepted")
+	}
+
+	for path, want := range map[string]bool{
+		"/robots.txt":         true,
+		"/static/app.js":      true,
+		"/static/./app.js":    true,
+		"/robots.txt2":        false,
+		"/":                   false,
+		"/static/../admin":    false,
+		"/static/../../admin": false,
+		"//static/../admin/":  false,
+	} {
+		if got := auth.Exempt(path); got != want {
+			t.Errorf("Exempt(%s): got %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestAuthSessionSurvivesReload(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	siteDir := filepath.Join(dir, "site")
+	if err := os.MkdirAll(siteDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"config.json": `{"websites": {"a.com": "a.test", "b.com": "b.test"}}`,
+		"a.com.json":  `{"auth": {"mode": "login", "users": {"alice": "` + string(hash) + `"}}}`,
+		"b.com.json":  `{"auth": {"mode": "login", "users": {"alice": "` + string(hash) + `"}}}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(siteDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewRegistry(dir, 0)
+	if err := r.LoadAllSites(); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := r.GetSiteConfig("a.test")
+	cookie := a.Auth.SessionCookie("alice")
+
+	if err := r.LoadAllSites(); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = r.GetSiteConfig("a.test")
+	if !a.Auth.VerifySessionCookie(cookie) {
+		t.Error("login cookie rejected after a reload")
+	}
+	if b, _ := r.GetSiteConfig("b.test"); b.Auth.VerifySessionCookie(cookie) {
+		t.Error("login cookie of another website accepted")
+	}
+}
+
+func TestAuthFailedLogins(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &AuthConfig{Users: map[string]string{"alice": string(hash)}, FailedLogins: RateLimit{Rate: 0.01, Burst: 2}}
+	auth.setDefaults()
+	if err := auth.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// unknown users are checked against a real hash, as slow as known ones
+	if cost, err := bcrypt.Cost(auth.dummyHash); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("expected a dummy hash of the users' cost, got %d, %v", cost, err)
+	}
+
+	for range 2 {
+		if ok, _ := auth.LoginAllowed("a"); !ok {
+			t.Fatal("login refused within the burst")
+		}
+		auth.LoginFailed("a")
+	}
+	if ok, retryAfter := auth.LoginAllowed("a"); ok || retryAfter <= 0 {
+		t.Errorf("expected the login to be refused with a retry time, got %v %v", ok, retryAfter)
+	}
+	if ok, _ := auth.LoginAllowed("b"); !ok {
+		t.Error("another client refused")
+	}
+
+	defaults := &AuthConfig{}
+	defaults.setDefaults()
+	if defaults.FailedLogins != (RateLimit{Rate: 0.1, Burst: 10}) {
+		t.Errorf("unexpected default failed logins %+v", defaults.FailedLogins)
+	}
+}
@@ -1,8 +1,13 @@
 package siteconfig
 
-import "time"
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"time"
+)
 
-const cacheTtl = time.Minute * 120
+const defaultCacheTtl = time.Minute * 120
 
 var cacheHeaders = []string{
 	"Content-Type",
@@ -17,3 +22,76 @@ type PageCacheEntry struct {
 	Status    int
 	Headers   map[string]string
 }
+
+// CacheStats returns the number of cached pages and their total content size.
+func (w *WebsiteConfig) CacheStats() (entries int, size int) {
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+
+	for _, entry := range w.cache {
+		size += len(entry.Content)
+	}
+	return len(w.cache), size
+}
+
+// SaveCaches writes the page caches of all websites to name, so a restarted
+// server can start with them.
+func (r *Registry) SaveCaches(name string) (entries int, err error) {
+	caches := make(map[string][]*PageCacheEntry)
+	for _, site := range r.GetAllSiteConfigs() {
+		site.cacheMu.Lock()
+		for _, entry := range site.cache {
+			caches[site.MirrorHost()] = append(caches[site.MirrorHost()], entry)
+		}
+		entries += len(site.cache)
+		site.cacheMu.Unlock()
+	}
+
+	// write next to the old file and swap, a crash must not leave half a cache behind
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	err = gob.NewEncoder(f).Encode(caches)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return entries, os.Rename(f.Name(), name)
+}
+
+// LoadCaches fills the page caches from a file written by SaveCaches. Entries
+// of websites that are gone are dropped, a missing file is not an error.
+func (r *Registry) LoadCaches(name string) (entries int, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var caches map[string][]*PageCacheEntry
+	if err := gob.NewDecoder(f).Decode(&caches); err != nil {
+		return 0, err
+	}
+	for host, cache := range caches {
+		site, ok := r.GetSiteConfig(host)
+		if !ok || site.NoCache {
+			continue
+		}
+		site.cacheMu.Lock()
+		for _, entry := range cache {
+			if _, ok := site.cache[entry.Path]; !ok {
+				site.cache[entry.Path] = entry
+				entries++
+			}
+		}
+		site.cacheMu.Unlock()
+	}
+	return entries, nil
+}
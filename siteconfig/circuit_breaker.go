@@ -0,0 +1,168 @@
+package siteconfig
+
+import (
+	"sync"
+	"time"
+	"website_proxier/duration"
+
+	"github.com/sirupsen/logrus"
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int               `json:"failure_threshold"`  // consecutive upstream failures that open the circuit
+	OpenDuration     duration.Duration `json:"open_duration"`      // how long to fail fast before trying again
+	HalfOpenRequests int               `json:"half_open_requests"` // trial requests let through while half-open
+	ServeStale       bool              `json:"serve_stale"`        // serve expired cache entries while open
+}
+
+func (c *CircuitBreakerConfig) setDefaults() {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 5
+	}
+	c.OpenDuration.Duration = c.OpenDuration.Or(time.Second * 30)
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+}
+
+// CircuitBreaker tracks the health of a website upstream. A nil breaker lets
+// every request through.
+type CircuitBreaker struct {
+	cfg     CircuitBreakerConfig
+	website *WebsiteConfig
+	now     func() time.Time // time.Now, replaced in tests
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	trials   int
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig, website *WebsiteConfig) *CircuitBreaker {
+	cfg.setDefaults()
+	return &CircuitBreaker{
+		cfg:     cfg,
+		website: website,
+		now:     time.Now,
+		state:   CircuitClosed,
+	}
+}
+
+func (b *CircuitBreaker) setState(state CircuitState) {
+	logrus.WithFields(b.website.LogrusFieldsWithAction("circuit_breaker")).
+		WithField("from", b.state).
+		WithField("to", state).
+		Warn("Circuit breaker state changed")
+	b.state = state
+	b.trials = 0
+	if state == CircuitOpen {
+		b.openedAt = b.now()
+	}
+	if state == CircuitClosed {
+		b.failures = 0
+	}
+}
+
+// Allow reports whether a request may go upstream. Every allowed request must
+// be followed by Success, Failure or Cancel.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitOpen {
+		if b.now().Sub(b.openedAt) < b.cfg.OpenDuration.Duration {
+			return false
+		}
+		b.setState(CircuitHalfOpen)
+	}
+	if b.state == CircuitHalfOpen {
+		if b.trials >= b.cfg.HalfOpenRequests {
+			return false
+		}
+		b.trials++
+	}
+	return true
+}
+
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitHalfOpen {
+		b.setState(CircuitClosed)
+	}
+	b.failures = 0
+}
+
+func (b *CircuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitHalfOpen:
+		b.setState(CircuitOpen)
+	case CircuitClosed:
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.setState(CircuitOpen)
+		}
+	}
+}
+
+// Cancel releases an allowed request that ended without telling anything about
+// the upstream, for example because the client went away.
+func (b *CircuitBreaker) Cancel() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+func (b *CircuitBreaker) State() CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// RetryAfter returns how long the circuit stays open.
+func (b *CircuitBreaker) RetryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != CircuitOpen {
+		return 0
+	}
+	return max(b.cfg.OpenDuration.Duration-b.now().Sub(b.openedAt), 0)
+}
+
+func (b *CircuitBreaker) ServesStale() bool {
+	return b != nil && b.cfg.ServeStale
+}
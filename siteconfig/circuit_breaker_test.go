@@ -0,0 +1,98 @@
+package siteconfig
+
+import (
+	"testing"
+	"time"
+	"website_proxier/duration"
+)
+
+func newTestBreaker(cfg CircuitBreakerConfig) (*CircuitBreaker, *time.Time) {
+	now := time.Now()
+	b := newCircuitBreaker(cfg, &WebsiteConfig{BaseConfig: &SiteBaseConfig{Name: "test"}})
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b, now := newTestBreaker(CircuitBreakerConfig{FailureThreshold: 3, OpenDuration: duration.Duration{Duration: time.Minute}})
+
+	// a success resets the consecutive failures
+	for _, success := range []bool{false, false, true, false, false} {
+		if !b.Allow() {
+			t.Fatal("closed circuit failing fast")
+		}
+		if success {
+			b.Success()
+		} else {
+			b.Failure()
+		}
+	}
+	if b.State() != CircuitClosed {
+		t.Fatalf("opened below the threshold, %s", b.State())
+	}
+
+	b.Allow()
+	b.Failure()
+	if b.State() != CircuitOpen || b.Allow() {
+		t.Fatalf("expected an open circuit failing fast, %s", b.State())
+	}
+	*now = now.Add(time.Second * 20)
+	if got := b.RetryAfter(); got != time.Second*40 {
+		t.Errorf("expected to retry after 40s, got %v", got)
+	}
+
+	// half-open after the open duration, a failed trial opens again
+	*now = now.Add(time.Second * 40)
+	if !b.Allow() || b.State() != CircuitHalfOpen {
+		t.Fatalf("expected a trial request, %s", b.State())
+	}
+	b.Failure()
+	if b.State() != CircuitOpen || b.Allow() {
+		t.Fatalf("expected the failed trial to open the circuit, %s", b.State())
+	}
+
+	// a successful trial closes it
+	*now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatal("expected a trial request")
+	}
+	b.Success()
+	if b.State() != CircuitClosed || !b.Allow() {
+		t.Fatalf("expected the successful trial to close the circuit, %s", b.State())
+	}
+}
+
+func TestCircuitBreakerTrials(t *testing.T) {
+	b, now := newTestBreaker(CircuitBreakerConfig{FailureThreshold: 1, HalfOpenRequests: 2})
+	b.Allow()
+	b.Failure()
+	*now = now.Add(b.cfg.OpenDuration.Duration)
+
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("expected 2 trial requests")
+	}
+	if b.Allow() {
+		t.Fatal("more trials than half_open_requests let through")
+	}
+	// a trial that told nothing about the upstream frees its slot
+	b.Cancel()
+	if !b.Allow() {
+		t.Fatal("cancelled trial not released")
+	}
+	if b.Allow() {
+		t.Fatal("cancel released more than one trial")
+	}
+	if b.State() != CircuitHalfOpen {
+		t.Fatalf("expected half-open, %s", b.State())
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var b *CircuitBreaker
+	if !b.Allow() || b.State() != CircuitClosed || b.RetryAfter() != 0 || b.ServesStale() {
+		t.Error("nil breaker must let everything through")
+	}
+	b.Success()
+	b.Failure()
+	b.Cancel()
+}
@@ -0,0 +1,192 @@
+package siteconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Failure is why a request could not be answered with an upstream response.
+type Failure string
+
+const (
+	FailureTimeout           Failure = "timeout"            // the upstream did not answer in time
+	FailureConnectionRefused Failure = "connection_refused" // the upstream refused the connection
+	FailureUpstream          Failure = "upstream_error"     // any other error talking to the upstream
+	FailureTooManyRetries    Failure = "too_many_retries"   // every attempt got a retryable status
+	FailureDecode            Failure = "decode"             // the upstream body could not be decoded
+	FailureUpstream5xx       Failure = "upstream_5xx"       // the upstream answered with a 5xx status
+	FailureUnavailable       Failure = "unavailable"        // circuit open or no healthy proxy
+)
+
+// defaultErrorPage is used for failures without a page of their own.
+const defaultErrorPage Failure = "default"
+
+var failures = []Failure{
+	FailureTimeout,
+	FailureConnectionRefused,
+	FailureUpstream,
+	FailureTooManyRetries,
+	FailureDecode,
+	FailureUpstream5xx,
+	FailureUnavailable,
+	defaultErrorPage,
+}
+
+// FailureOf returns the failure of an upstream error class.
+func FailureOf(class ErrorClass) Failure {
+	switch class {
+	case ErrorClassTimeout:
+		return FailureTimeout
+	case ErrorClassConnectionRefused:
+		return FailureConnectionRefused
+	default:
+		return FailureUpstream
+	}
+}
+
+// Status returns the status sent to the client, upstream 5xx responses keep
+// the status of the upstream.
+func (f Failure) Status() int {
+	switch f {
+	case FailureTimeout:
+		return http.StatusGatewayTimeout
+	case FailureTooManyRetries, FailureUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// ErrorPage is a template for one failure, inline or from a file relative to
+// the site config directory. ${var} is replaced with the site vars and with
+// status, status_text, failure, request_id, host and path.
+type ErrorPage struct {
+	HTML     string `json:"html"`
+	HTMLFile string `json:"html_file"`
+	JSON     string `json:"json"`
+	JSONFile string `json:"json_file"`
+}
+
+// ErrorPagesConfig replaces the plain text error responses of a website.
+// Upstream 5xx responses are only replaced when there is an upstream_5xx page.
+type ErrorPagesConfig struct {
+	Pages     map[Failure]ErrorPage `json:"pages"`      // by failure, "default" for the others
+	JSONPaths []string              `json:"json_paths"` // answered with the JSON template, a trailing * matches a prefix
+}
+
+// errorTemplate is an ErrorPage with the files read and the site vars applied.
+type errorTemplate struct {
+	html, json string
+}
+
+func escapeJSON(value string) string {
+	quoted, _ := json.Marshal(value)
+	return string(quoted[1 : len(quoted)-1])
+}
+
+func readTemplate(inline, file, dir string) (string, error) {
+	if file == "" {
+		return inline, nil
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	content, err := os.ReadFile(file)
+	return string(content), err
+}
+
+// compile reads the template files and applies the site vars.
+func (c *ErrorPagesConfig) compile(dir string, vars map[string]string) (map[Failure]errorTemplate, error) {
+	templates := make(map[Failure]errorTemplate, len(c.Pages))
+	for failure, page := range c.Pages {
+		if !slices.Contains(failures, failure) {
+			return nil, fmt.Errorf("unknown failure: %s", failure)
+		}
+		htmlTemplate, err := readTemplate(page.HTML, page.HTMLFile, dir)
+		if err != nil {
+			return nil, err
+		}
+		jsonTemplate, err := readTemplate(page.JSON, page.JSONFile, dir)
+		if err != nil {
+			return nil, err
+		}
+		var t errorTemplate
+		if t.html, err = formatStringEscaped(htmlTemplate, vars, html.EscapeString); err != nil {
+			return nil, fmt.Errorf("error formatting %s page: %w", failure, err)
+		}
+		if t.json, err = formatStringEscaped(jsonTemplate, vars, escapeJSON); err != nil {
+			return nil, fmt.Errorf("error formatting %s page: %w", failure, err)
+		}
+		templates[failure] = t
+	}
+	return templates, nil
+}
+
+// inline returns the config with the template files read into the inline
+// templates.
+func (c *ErrorPagesConfig) inline(dir string) (*ErrorPagesConfig, error) {
+	inlined := &ErrorPagesConfig{Pages: make(map[Failure]ErrorPage, len(c.Pages)), JSONPaths: c.JSONPaths}
+	for failure, page := range c.Pages {
+		var err error
+		if page.HTML, err = readTemplate(page.HTML, page.HTMLFile, dir); err != nil {
+			return nil, err
+		}
+		if page.JSON, err = readTemplate(page.JSON, page.JSONFile, dir); err != nil {
+			return nil, err
+		}
+		page.HTMLFile, page.JSONFile = "", ""
+		inlined.Pages[failure] = page
+	}
+	return inlined, nil
+}
+
+func (c *ErrorPagesConfig) isJSONPath(path string) bool {
+	for _, jsonPath := range c.JSONPaths {
+		if prefix, ok := strings.CutSuffix(jsonPath, "*"); ok && strings.HasPrefix(path, prefix) || path == jsonPath {
+			return true
+		}
+	}
+	return false
+}
+
+// HasErrorPage reports whether the website has a page for the failure itself,
+// not counting the default page.
+func (w *WebsiteConfig) HasErrorPage(failure Failure) bool {
+	_, ok := w.errorTemplates[failure]
+	return ok
+}
+
+// ErrorPage renders the page of a failure for path with the request vars. It
+// returns false when the website has no page for it.
+func (w *WebsiteConfig) ErrorPage(failure Failure, path string, vars map[string]string) (body []byte, contentType string, ok bool) {
+	if w.ErrorPages == nil {
+		return nil, "", false
+	}
+	t, ok := w.errorTemplates[failure]
+	if !ok {
+		if t, ok = w.errorTemplates[defaultErrorPage]; !ok {
+			return nil, "", false
+		}
+	}
+
+	template, escape := t.html, html.EscapeString
+	contentType = "text/html; charset=utf-8"
+	if w.ErrorPages.isJSONPath(path) {
+		template, escape = t.json, escapeJSON
+		contentType = "application/json"
+	}
+	if template == "" {
+		return nil, "", false
+	}
+	formatted, err := formatStringEscaped(template, vars, escape)
+	if err != nil {
+		return nil, "", false
+	}
+	return []byte(formatted), contentType, true
+}
@@ -0,0 +1,39 @@
+package siteconfig
+
+import "testing"
+
+func TestErrorPage(t *testing.T) {
+	pages := &ErrorPagesConfig{
+		Pages: map[Failure]ErrorPage{
+			FailureTimeout:   {HTML: "<p>${domain:upper} timed out at ${path}</p>", JSON: `{"error": "${failure}", "path": "${path}"}`},
+			defaultErrorPage: {HTML: "<p>${status} ${status_text}</p>"},
+		},
+		JSONPaths: []string{"/api/*"},
+	}
+	templates, err := pages.compile("", map[string]string{"domain": "a&b.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := &WebsiteConfig{ErrorPages: pages, errorTemplates: templates}
+
+	tests := []struct {
+		failure     Failure
+		path        string
+		body        string
+		contentType string
+	}{
+		{FailureTimeout, "/<x>", "<p>A&amp;B.TEST timed out at /&lt;x&gt;</p>", "text/html; charset=utf-8"},
+		{FailureTimeout, `/api/"x"`, `{"error": "timeout", "path": "/api/\"x\""}`, "application/json"},
+		{FailureDecode, "/", "<p>502 Bad Gateway</p>", "text/html; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		vars := map[string]string{"failure": string(tt.failure), "path": tt.path, "status": "502", "status_text": "Bad Gateway"}
+		body, contentType, ok := site.ErrorPage(tt.failure, tt.path, vars)
+		if !ok || string(body) != tt.body || contentType != tt.contentType {
+			t.Errorf("%s %s: got %v %q %q", tt.failure, tt.path, ok, body, contentType)
+		}
+	}
+	if _, _, ok := site.ErrorPage(FailureDecode, "/api/x", nil); ok {
+		t.Error("default page has no JSON template")
+	}
+}
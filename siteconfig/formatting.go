@@ -8,6 +8,12 @@ import (
 var fmtRegex = regexp.MustCompile(`\$\{([a-zA-Z0-9_:()]+)}`)
 
 func formatString(s string, dictionary map[string]string) (string, error) {
+	return formatStringEscaped(s, dictionary, func(value string) string { return value })
+}
+
+// formatStringEscaped is formatString with the formatted values escaped for
+// the document they end up in.
+func formatStringEscaped(s string, dictionary map[string]string, escape func(string) string) (string, error) {
 	formatPieces := fmtRegex.FindAllStringSubmatch(s, -1)
 	for _, pieces := range formatPieces {
 		split := strings.Split(pieces[1], ":")
@@ -17,13 +23,13 @@ func formatString(s string, dictionary map[string]string) (string, error) {
 		}
 		formatters := split[1:]
 		if len(formatters) == 0 {
-			s = strings.ReplaceAll(s, pieces[0], dictionary[variable])
+			s = strings.ReplaceAll(s, pieces[0], escape(dictionary[variable]))
 		} else {
 			formatted, err := formatWithFormatters(dictionary[variable], formatters)
 			if err != nil {
 				return "", err
 			}
-			s = strings.ReplaceAll(s, pieces[0], formatted)
+			s = strings.ReplaceAll(s, pieces[0], escape(formatted))
 		}
 	}
 
@@ -0,0 +1,237 @@
+package siteconfig
+
+import (
+	"cmp"
+	"container/list"
+	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxPatternWebsites bounds the websites resolved from one host pattern, any
+// Host header matching the pattern creates one. The least recently used one
+// goes first, its cache with it.
+const maxPatternWebsites = 1000
+
+// A host pattern maps many mirror hosts with a single Websites entry and a
+// single website config, shared as a template:
+//
+//	"*.neal.fun": "*.${domain}"                          wildcard, one label, available as ${label}
+//	"${sub}.neal.fun": "~^(?P<sub>[a-z0-9-]+)\\.x\\.com$"  regex on the mirror host, named groups are vars
+//
+// The captured values are vars of the website config, for replacements and
+// error pages. Mirror hosts are matched lowercased and without a port. The
+// websites of a pattern share its rate limiter, IP filter and error page files,
+// and are labeled with the pattern in metrics.
+type hostPattern struct {
+	base       *SiteBaseConfig
+	origin     string         // the Websites key
+	mirrorHost string         // the Websites value
+	target     string         // the target host, with vars for the captures
+	mirror     *regexp.Regexp // matches mirror hosts
+	wildcard   bool
+	template   []byte         // the website config
+	shared     *WebsiteConfig // built from the template, holds what the websites share
+
+	mu       sync.Mutex
+	websites map[string]*list.Element // resolved, by mirror host
+	recent   *list.List               // of *WebsiteConfig, most recently used first
+}
+
+func isHostPattern(origin, mirror string) bool {
+	return strings.Contains(origin, "*") || strings.HasPrefix(mirror, "*") || strings.HasPrefix(mirror, "~")
+}
+
+func (s *SiteBaseConfig) newHostPattern(origin, mirror string, template []byte) (*hostPattern, error) {
+	p := &hostPattern{
+		base:       s,
+		origin:     origin,
+		mirrorHost: mirror,
+		template:   template,
+		websites:   make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+	var err error
+	if expr, ok := strings.CutPrefix(mirror, "~"); ok {
+		if strings.Contains(origin, "*") {
+			return nil, fmt.Errorf("regex mirror host of %s must not have a wildcard origin", origin)
+		}
+		p.target = origin
+		p.mirror, err = regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling mirror host of %s: %w", origin, err)
+		}
+	} else {
+		originDomain, ok := strings.CutPrefix(origin, "*.")
+		mirrorDomain, mirrorOk := strings.CutPrefix(mirror, "*.")
+		if !ok || !mirrorOk || strings.Contains(originDomain, "*") || strings.Contains(mirrorDomain, "*") {
+			return nil, fmt.Errorf("wildcard mapping %s -> %s must start with *. on both sides", origin, mirror)
+		}
+		p.wildcard = true
+		p.target = "${label}." + originDomain
+		p.mirror = regexp.MustCompile(`^(?P<label>[a-zA-Z0-9-]+)\.` + regexp.QuoteMeta(mirrorDomain) + `$`)
+	}
+
+	// build one website to find config errors now rather than on the first
+	// request, and to share its parts
+	example := make([]string, len(p.mirror.SubexpNames()))
+	for i := range example {
+		example[i] = "example"
+	}
+	if p.shared, err = s.newWebsiteConfig(origin, mirror, template, p.vars(example), nil); err != nil {
+		return nil, err
+	}
+	if p.shared.ErrorPages != nil {
+		if p.shared.ErrorPages, err = p.shared.ErrorPages.inline(s.registry.dir + "/" + s.Name); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// normalizeHost lowercases a Host header and strips the port.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// vars returns the site vars with the captures of a match.
+func (p *hostPattern) vars(match []string) map[string]string {
+	vars := make(map[string]string, len(p.base.Vars)+len(match))
+	maps.Copy(vars, p.base.Vars)
+	for i, name := range p.mirror.SubexpNames() {
+		if name != "" {
+			vars[name] = match[i]
+		}
+	}
+	return vars
+}
+
+// resolve returns the website of a mirror host matching the pattern, building
+// it on first use.
+func (p *hostPattern) resolve(host string) (*WebsiteConfig, bool) {
+	host = normalizeHost(host)
+	match := p.mirror.FindStringSubmatch(host)
+	if match == nil {
+		return nil, false
+	}
+	if website, ok := p.lookup(host); ok {
+		return website, true
+	}
+
+	// built without the lock, nothing in it is read from disk
+	vars := p.vars(match)
+	target, err := formatString(p.target, vars)
+	if err != nil {
+		logrus.WithFields(p.base.LogrusFields()).WithField("host", host).WithError(err).Error("Error resolving website")
+		return nil, false
+	}
+	website, err := p.base.newWebsiteConfig(target, host, p.template, vars, p.shared)
+	if err != nil {
+		logrus.WithFields(p.base.LogrusFields()).WithField("host", host).WithError(err).Error("Error resolving website")
+		return nil, false
+	}
+	website.metricsHost = p.mirrorHost
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if element, ok := p.websites[host]; ok {
+		// resolved by another request meanwhile
+		p.recent.MoveToFront(element)
+		return element.Value.(*WebsiteConfig), true
+	}
+	if p.recent.Len() >= maxPatternWebsites {
+		evicted := p.recent.Remove(p.recent.Back()).(*WebsiteConfig)
+		delete(p.websites, evicted.MirrorHost())
+	}
+	p.websites[host] = p.recent.PushFront(website)
+	return website, true
+}
+
+// lookup returns an already resolved website and marks it used.
+func (p *hostPattern) lookup(host string) (*WebsiteConfig, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	element, ok := p.websites[host]
+	if !ok {
+		return nil, false
+	}
+	p.recent.MoveToFront(element)
+	return element.Value.(*WebsiteConfig), true
+}
+
+// carryOver resolves the hosts of the pattern a reload replaces, their caches
+// and order of use included.
+func (p *hostPattern) carryOver(previous *hostPattern) {
+	if previous == nil {
+		return
+	}
+	previous.mu.Lock()
+	websites := make([]*WebsiteConfig, 0, previous.recent.Len())
+	for element := previous.recent.Back(); element != nil; element = element.Prev() {
+		websites = append(websites, element.Value.(*WebsiteConfig))
+	}
+	previous.mu.Unlock()
+	for _, previousWebsite := range websites {
+		website, ok := p.resolve(previousWebsite.MirrorHost())
+		if !ok {
+			continue
+		}
+		previousWebsite.cacheMu.Lock()
+		maps.Copy(website.cache, previousWebsite.cache)
+		previousWebsite.cacheMu.Unlock()
+	}
+}
+
+func (p *hostPattern) resolved() []*WebsiteConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	websites := make([]*WebsiteConfig, 0, p.recent.Len())
+	for element := p.recent.Front(); element != nil; element = element.Next() {
+		websites = append(websites, element.Value.(*WebsiteConfig))
+	}
+	return websites
+}
+
+// patternsOf returns the host patterns of a site by Websites key.
+func (r *Registry) patternsOf(s *SiteBaseConfig) map[string]*hostPattern {
+	r.websiteLock.RLock()
+	defer r.websiteLock.RUnlock()
+
+	patterns := make(map[string]*hostPattern)
+	for _, p := range r.patterns {
+		if p.base == s {
+			patterns[p.origin] = p
+		}
+	}
+	return patterns
+}
+
+// setPatterns replaces the host patterns of a site, websiteLock must be held.
+// Regex patterns are tried before the catch-all wildcards.
+func (r *Registry) setPatterns(s *SiteBaseConfig, patterns []*hostPattern) {
+	kept := r.patterns[:0:0]
+	for _, p := range r.patterns {
+		if p.base != s {
+			kept = append(kept, p)
+		}
+	}
+	r.patterns = append(kept, patterns...)
+	slices.SortStableFunc(r.patterns, func(a, b *hostPattern) int {
+		if a.wildcard != b.wildcard {
+			if a.wildcard {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(strings.Compare(a.base.Name, b.base.Name), strings.Compare(a.origin, b.origin))
+	})
+}
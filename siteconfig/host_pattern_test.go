@@ -0,0 +1,110 @@
+package siteconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostPattern(t *testing.T) {
+	dir := t.TempDir()
+	siteDir := filepath.Join(dir, "neal")
+	if err := os.MkdirAll(siteDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"config.json": `{"vars": {"domain": "mirror.test"}, "websites": {
+			"neal.fun": "${domain}",
+			"*.neal.fun": "*.${domain}",
+			"${region}-cdn.neal.fun": "~^cdn-(?P<region>[a-z]+)\\.${domain}$"
+		}}`,
+		"neal.fun.json":               `{}`,
+		"*.neal.fun.json":             `{"replacements": [{"from": "${label}.neal.fun", "to": "${label}.${domain}"}], "rate_limit": {"per_site": {"upstream": {"rate": 1}}}}`,
+		"${region}-cdn.neal.fun.json": `{}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(siteDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewRegistry(dir, 0)
+	if err := r.LoadAllSites(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"mirror.test":        "neal.fun",
+		"api.mirror.test":    "api.neal.fun",
+		"cdn-eu.mirror.test": "eu-cdn.neal.fun",
+	}
+	for host, target := range tests {
+		site, ok := r.GetSiteConfig(host)
+		if !ok || site.TargetHost != target || site.MirrorHost() != host {
+			t.Errorf("%s: got %v %+v", host, ok, site)
+		}
+	}
+	for _, host := range []string{"a.b.mirror.test", "mirror.test.evil", "mirror.test:8080", "cdn-eu.mirror.test.evil"} {
+		if _, ok := r.GetSiteConfig(host); ok {
+			t.Errorf("%s resolved", host)
+		}
+	}
+
+	// for certificates, matched without building websites
+	websites := len(r.GetAllSiteConfigs())
+	for host, want := range map[string]bool{"mirror.test": true, "new.mirror.test": true, "CDN-US.mirror.test": true, "a.b.mirror.test": false} {
+		if got := r.Serves(host); got != want {
+			t.Errorf("Serves(%s): got %v, want %v", host, got, want)
+		}
+	}
+	if got := len(r.GetAllSiteConfigs()); got != websites {
+		t.Errorf("Serves resolved websites, %d instead of %d", got, websites)
+	}
+
+	site, _ := r.GetSiteConfig("api.mirror.test")
+	if got := string(site.Replace([]byte("https://api.neal.fun/x"))); got != "https://api.mirror.test/x" {
+		t.Errorf("label not applied to replacements: %s", got)
+	}
+	for _, host := range []string{"api.mirror.test", "API.Mirror.Test", "api.mirror.test:8443"} {
+		if again, _ := r.GetSiteConfig(host); again != site {
+			t.Errorf("%s: resolved website not reused", host)
+		}
+	}
+	if site.MetricsHost() != "*.mirror.test" {
+		t.Errorf("expected the pattern as metrics host, got %s", site.MetricsHost())
+	}
+	if other, _ := r.GetSiteConfig("cdn1.mirror.test"); other.RateLimiter() != site.RateLimiter() {
+		t.Error("rate limiter not shared by the websites of a pattern")
+	}
+	if len(r.GetAllSiteConfigs()) != 4 {
+		t.Errorf("expected 4 websites, got %d", len(r.GetAllSiteConfigs()))
+	}
+}
+
+func TestHostPatternEviction(t *testing.T) {
+	r := NewRegistry(t.TempDir(), 0)
+	s := &SiteBaseConfig{Name: "site", registry: r}
+	p, err := s.newHostPattern("*.example.com", "*.mirror.test", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := p.resolve("first.mirror.test")
+	for i := range maxPatternWebsites - 1 {
+		p.resolve(fmt.Sprintf("h%d.mirror.test", i))
+	}
+	// used again, the least recently used is h0 now
+	if again, _ := p.resolve("first.mirror.test"); again != first {
+		t.Fatal("resolved website not reused")
+	}
+	p.resolve("new.mirror.test")
+
+	if len(p.websites) != maxPatternWebsites {
+		t.Errorf("expected %d websites, got %d", maxPatternWebsites, len(p.websites))
+	}
+	if _, ok := p.lookup("first.mirror.test"); !ok {
+		t.Error("recently used website evicted")
+	}
+	if _, ok := p.lookup("h0.mirror.test"); ok {
+		t.Error("least recently used website kept")
+	}
+}
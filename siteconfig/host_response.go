@@ -0,0 +1,79 @@
+package siteconfig
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"website_proxier/duration"
+)
+
+type HostAction string
+
+const (
+	HostRedirect    HostAction = "redirect"    // redirect to Location
+	HostPage        HostAction = "page"        // serve a static page
+	HostStatus      HostAction = "status"      // a bare status like 404, 410 or 451
+	HostClose       HostAction = "close"       // close the connection without a response
+	HostUnavailable HostAction = "unavailable" // a temporarily unavailable page with Retry-After
+)
+
+// HostResponse is what requests for unknown or deactivated hosts get.
+type HostResponse struct {
+	Action      HostAction        `json:"action"`
+	Location    string            `json:"location"`     // for redirect
+	Status      int               `json:"status"`       // 302 for redirect, 200 for page, 404 for status, 503 for unavailable
+	Body        string            `json:"body"`         // for page and unavailable
+	BodyFile    string            `json:"body_file"`    // instead of Body, relative to the config directory
+	ContentType string            `json:"content_type"` // text/html when empty
+	RetryAfter  duration.Duration `json:"retry_after"`  // for unavailable, an hour when unset
+}
+
+// DefaultUnknownHost is used when no unknown host response is configured.
+var DefaultUnknownHost = HostResponse{
+	Action:   HostRedirect,
+	Location: "https://www.godaddy.com/websites/website-builder",
+}
+
+// Prepare checks the response, fills in the defaults and reads the body file,
+// relative to dir.
+func (h *HostResponse) Prepare(dir string) error {
+	defaultStatus := map[HostAction]int{
+		HostRedirect:    http.StatusFound,
+		HostPage:        http.StatusOK,
+		HostStatus:      http.StatusNotFound,
+		HostClose:       0,
+		HostUnavailable: http.StatusServiceUnavailable,
+	}
+	status, ok := defaultStatus[h.Action]
+	if !ok {
+		return fmt.Errorf("unknown host action: %s", h.Action)
+	}
+	if h.Status == 0 {
+		h.Status = status
+	}
+	if h.Action != HostClose && http.StatusText(h.Status) == "" {
+		return fmt.Errorf("invalid status: %d", h.Status)
+	}
+	if h.Action == HostRedirect && h.Location == "" {
+		return fmt.Errorf("redirect without location")
+	}
+	if h.ContentType == "" {
+		h.ContentType = "text/html; charset=utf-8"
+	}
+	h.RetryAfter.Duration = h.RetryAfter.Or(time.Hour)
+
+	if h.BodyFile != "" {
+		name := h.BodyFile
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		h.Body = string(body)
+	}
+	return nil
+}
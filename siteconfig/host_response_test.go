@@ -0,0 +1,64 @@
+package siteconfig
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHostResponsePrepare(t *testing.T) {
+	tests := []struct {
+		response HostResponse
+		status   int
+		valid    bool
+	}{
+		{HostResponse{Action: HostRedirect, Location: "https://example.com/"}, http.StatusFound, true},
+		{HostResponse{Action: HostRedirect, Location: "https://example.com/", Status: http.StatusMovedPermanently}, http.StatusMovedPermanently, true},
+		{HostResponse{Action: HostRedirect}, 0, false},
+		{HostResponse{Action: HostPage}, http.StatusOK, true},
+		{HostResponse{Action: HostStatus}, http.StatusNotFound, true},
+		{HostResponse{Action: HostStatus, Status: 999}, 0, false},
+		{HostResponse{Action: HostClose}, 0, true},
+		{HostResponse{Action: HostUnavailable}, http.StatusServiceUnavailable, true},
+		{HostResponse{Action: "drop"}, 0, false},
+		{HostResponse{}, 0, false},
+	}
+	for _, tt := range tests {
+		response := tt.response
+		err := response.Prepare("")
+		if (err == nil) != tt.valid {
+			t.Errorf("%+v: expected valid %v, got %v", tt.response, tt.valid, err)
+			continue
+		}
+		if tt.valid && response.Status != tt.status {
+			t.Errorf("%+v: expected status %d, got %d", tt.response, tt.status, response.Status)
+		}
+	}
+
+	response := HostResponse{Action: HostUnavailable}
+	_ = response.Prepare("")
+	if response.ContentType != "text/html; charset=utf-8" || response.RetryAfter.Duration != time.Hour {
+		t.Errorf("expected the default content type and retry, got %q %v", response.ContentType, response.RetryAfter)
+	}
+}
+
+func TestHostResponseBodyFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "parked.html"), []byte("<p>parked</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	response := HostResponse{Action: HostPage, Body: "ignored", BodyFile: "parked.html"}
+	if err := response.Prepare(dir); err != nil {
+		t.Fatal(err)
+	}
+	if response.Body != "<p>parked</p>" {
+		t.Errorf("expected the body file relative to the directory, got %q", response.Body)
+	}
+
+	response = HostResponse{Action: HostPage, BodyFile: "missing.html"}
+	if err := response.Prepare(dir); err == nil {
+		t.Error("expected a missing body file to fail")
+	}
+}
@@ -0,0 +1,44 @@
+package siteconfig
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type MatchType string
+
+const (
+	MatchTypePrefix MatchType = ""
+	MatchTypeRegex  MatchType = "regex"
+)
+
+// ProxyRule routes the paths it matches through a proxy group, overriding
+// WebsiteConfig.ProxyGroup.
+type ProxyRule struct {
+	Path  string    `json:"path"`
+	Type  MatchType `json:"type,omitempty"`
+	Group string    `json:"group"`
+
+	compiledRegex *regexp.Regexp
+}
+
+func (r *ProxyRule) compile() error {
+	switch r.Type {
+	case MatchTypePrefix:
+		return nil
+	case MatchTypeRegex:
+		var err error
+		r.compiledRegex, err = regexp.Compile(r.Path)
+		return err
+	default:
+		return fmt.Errorf("unknown match type: %s", r.Type)
+	}
+}
+
+func (r *ProxyRule) Matches(path string) bool {
+	if r.Type == MatchTypeRegex {
+		return r.compiledRegex.MatchString(path)
+	}
+	return strings.HasPrefix(path, r.Path)
+}
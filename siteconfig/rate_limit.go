@@ -0,0 +1,193 @@
+package siteconfig
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"website_proxier/duration"
+)
+
+// Budget is what a rate limited request spends tokens on.
+type Budget string
+
+const (
+	BudgetCache    Budget = "cache"    // requests answered from the page cache
+	BudgetUpstream Budget = "upstream" // requests fetched from the upstream
+)
+
+// RateLimit is a token bucket, Rate tokens per second up to Burst.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // requests per second, unlimited when zero
+	Burst int     `json:"burst"` // the rate rounded up when zero
+}
+
+func (l *RateLimit) setDefaults() {
+	if l.Burst <= 0 {
+		l.Burst = int(math.Ceil(l.Rate))
+	}
+}
+
+// RateLimits are the separate budgets of cache hits and upstream fetches.
+type RateLimits struct {
+	Cache    RateLimit `json:"cache"`
+	Upstream RateLimit `json:"upstream"`
+}
+
+func (l *RateLimits) setDefaults() {
+	l.Cache.setDefaults()
+	l.Upstream.setDefaults()
+}
+
+func (l *RateLimits) budget(budget Budget) RateLimit {
+	if budget == BudgetCache {
+		return l.Cache
+	}
+	return l.Upstream
+}
+
+type RateLimitConfig struct {
+	PerIP              RateLimits        `json:"per_ip"`
+	PerSite            RateLimits        `json:"per_site"`
+	MaxConcurrentPerIP int               `json:"max_concurrent_per_ip"` // unlimited when zero
+	ClientIdleTimeout  duration.Duration `json:"client_idle_timeout"`   // how long the state of a quiet client is kept
+}
+
+func (c *RateLimitConfig) setDefaults() {
+	c.PerIP.setDefaults()
+	c.PerSite.setDefaults()
+	c.ClientIdleTimeout.Duration = c.ClientIdleTimeout.Or(time.Minute * 10)
+}
+
+func (c *RateLimitConfig) validate() error {
+	for _, limit := range []RateLimit{c.PerIP.Cache, c.PerIP.Upstream, c.PerSite.Cache, c.PerSite.Upstream} {
+		if limit.Rate < 0 {
+			return fmt.Errorf("negative rate: %v", limit.Rate)
+		}
+	}
+	if c.MaxConcurrentPerIP < 0 {
+		return fmt.Errorf("negative max_concurrent_per_ip: %d", c.MaxConcurrentPerIP)
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// wait refills the bucket and returns how long until a token is available,
+// zero when one is available now.
+func (b *tokenBucket) wait(limit RateLimit, now time.Time) time.Duration {
+	if limit.Rate <= 0 {
+		return 0
+	}
+	if b.updatedAt.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.updatedAt).Seconds()*limit.Rate, float64(limit.Burst))
+	}
+	b.updatedAt = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(limit RateLimit) {
+	if limit.Rate > 0 {
+		b.tokens--
+	}
+}
+
+type clientLimits struct {
+	buckets  map[Budget]*tokenBucket
+	active   int
+	lastSeen time.Time
+}
+
+// RateLimiter enforces the rate limits of a website. A nil limiter lets every
+// request through.
+type RateLimiter struct {
+	cfg RateLimitConfig
+
+	mu          sync.Mutex
+	site        map[Budget]*tokenBucket
+	clients     map[string]*clientLimits
+	lastPruneAt time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	cfg.setDefaults()
+	return &RateLimiter{
+		cfg:     cfg,
+		site:    map[Budget]*tokenBucket{BudgetCache: {}, BudgetUpstream: {}},
+		clients: make(map[string]*clientLimits),
+	}
+}
+
+func (l *RateLimiter) client(ip string, now time.Time) *clientLimits {
+	if now.Sub(l.lastPruneAt) > l.cfg.ClientIdleTimeout.Duration {
+		for key, client := range l.clients {
+			if client.active == 0 && now.Sub(client.lastSeen) > l.cfg.ClientIdleTimeout.Duration {
+				delete(l.clients, key)
+			}
+		}
+		l.lastPruneAt = now
+	}
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &clientLimits{buckets: map[Budget]*tokenBucket{BudgetCache: {}, BudgetUpstream: {}}}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+	return client
+}
+
+// Allow spends a token of the client and of the site on the budget. When
+// either has none left, nothing is spent and the time until the request
+// would be allowed is returned with perIP telling which limit was hit.
+func (l *RateLimiter) Allow(ip string, budget Budget) (ok bool, perIP bool, retryAfter time.Duration) {
+	if l == nil {
+		return true, false, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	ipLimit, siteLimit := l.cfg.PerIP.budget(budget), l.cfg.PerSite.budget(budget)
+	ipBucket, siteBucket := l.client(ip, now).buckets[budget], l.site[budget]
+	if wait := ipBucket.wait(ipLimit, now); wait > 0 {
+		return false, true, wait
+	}
+	if wait := siteBucket.wait(siteLimit, now); wait > 0 {
+		return false, false, wait
+	}
+	ipBucket.take(ipLimit)
+	siteBucket.take(siteLimit)
+	return true, false, 0
+}
+
+// Acquire counts a request of the client as in progress until release is
+// called. It fails when the client already has the maximum in progress.
+func (l *RateLimiter) Acquire(ip string) (release func(), ok bool) {
+	if l == nil || l.cfg.MaxConcurrentPerIP <= 0 {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client := l.client(ip, time.Now())
+	if client.active >= l.cfg.MaxConcurrentPerIP {
+		return nil, false
+	}
+	client.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			client.active--
+		})
+	}, true
+}
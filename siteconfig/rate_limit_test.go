@@ -0,0 +1,42 @@
+package siteconfig
+
+import "testing"
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{
+		PerIP:              RateLimits{Upstream: RateLimit{Rate: 1, Burst: 2}},
+		PerSite:            RateLimits{Upstream: RateLimit{Rate: 1, Burst: 3}},
+		MaxConcurrentPerIP: 1,
+	})
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := l.Allow("a", BudgetUpstream); !ok {
+			t.Fatalf("request %d of a rejected within the burst", i)
+		}
+	}
+	if ok, perIP, retryAfter := l.Allow("a", BudgetUpstream); ok || !perIP || retryAfter <= 0 {
+		t.Errorf("expected a per-IP rejection with a retry time, got ok %v, perIP %v, retryAfter %s", ok, perIP, retryAfter)
+	}
+	if ok, _, _ := l.Allow("a", BudgetCache); !ok {
+		t.Error("cache hits are not limited")
+	}
+	if ok, _, _ := l.Allow("b", BudgetUpstream); !ok {
+		t.Error("b rejected with a token left on the site")
+	}
+	if ok, perIP, _ := l.Allow("c", BudgetUpstream); ok || perIP {
+		t.Errorf("expected a per-site rejection, got ok %v, perIP %v", ok, perIP)
+	}
+
+	release, ok := l.Acquire("a")
+	if !ok {
+		t.Fatal("first request of a rejected")
+	}
+	if _, ok := l.Acquire("a"); ok {
+		t.Error("second concurrent request of a allowed")
+	}
+	release()
+	release()
+	if _, ok := l.Acquire("a"); !ok {
+		t.Error("request of a rejected after release")
+	}
+}
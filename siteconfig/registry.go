@@ -0,0 +1,179 @@
+package siteconfig
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Registry holds the sites loaded from a config directory, one directory per
+// site, and the websites they mirror by mirror host.
+type Registry struct {
+	dir      string
+	cacheTtl time.Duration
+
+	websites    map[string]*WebsiteConfig
+	patterns    []*hostPattern // tried in order when no website has the host, see setPatterns
+	websiteLock sync.RWMutex
+	baseConfigs map[string]*SiteBaseConfig
+	baseLock    sync.RWMutex
+
+	sessionSecret []byte // random, see sessionKey
+}
+
+// NewRegistry returns an empty registry for dir, LoadAllSites loads it.
+// Cached pages are served for cacheTtl, 2 hours when zero.
+func NewRegistry(dir string, cacheTtl time.Duration) *Registry {
+	if cacheTtl <= 0 {
+		cacheTtl = defaultCacheTtl
+	}
+	sessionSecret := make([]byte, 32)
+	_, _ = rand.Read(sessionSecret)
+	return &Registry{
+		dir:           dir,
+		cacheTtl:      cacheTtl,
+		websites:      make(map[string]*WebsiteConfig),
+		baseConfigs:   make(map[string]*SiteBaseConfig),
+		sessionSecret: sessionSecret,
+	}
+}
+
+// GetSiteConfig returns the website mirrored on host, resolving host patterns
+// when no website has the host itself.
+func (r *Registry) GetSiteConfig(host string) (*WebsiteConfig, bool) {
+	r.websiteLock.RLock()
+
+	config, ok := r.websites[host]
+	patterns := r.patterns
+	r.websiteLock.RUnlock()
+	if ok {
+		return config, true
+	}
+
+	for _, pattern := range patterns {
+		if config, ok := pattern.resolve(host); ok {
+			return config, true
+		}
+	}
+	return nil, false
+}
+
+// Serves reports whether host is the mirror host of a website or matches a
+// host pattern, without resolving the pattern.
+func (r *Registry) Serves(host string) bool {
+	host = normalizeHost(host)
+	r.websiteLock.RLock()
+	defer r.websiteLock.RUnlock()
+
+	if _, ok := r.websites[host]; ok {
+		return true
+	}
+	for _, pattern := range r.patterns {
+		if pattern.mirror.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registry) GetAllSiteConfigs() []*WebsiteConfig {
+	r.websiteLock.RLock()
+	defer r.websiteLock.RUnlock()
+
+	configs := make([]*WebsiteConfig, 0, len(r.websites))
+	for _, config := range r.websites {
+		configs = append(configs, config)
+	}
+	for _, pattern := range r.patterns {
+		configs = append(configs, pattern.resolved()...)
+	}
+	return configs
+}
+
+func (r *Registry) GetBaseConfigByName(name string) (*SiteBaseConfig, bool) {
+	r.baseLock.RLock()
+	defer r.baseLock.RUnlock()
+
+	config, ok := r.baseConfigs[name]
+	return config, ok
+}
+
+func (r *Registry) getAllBaseConfigs() []*SiteBaseConfig {
+	r.baseLock.RLock()
+	defer r.baseLock.RUnlock()
+
+	configs := make([]*SiteBaseConfig, 0, len(r.baseConfigs))
+	for _, config := range r.baseConfigs {
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+func (r *Registry) loadSite(name string) (*SiteBaseConfig, error) {
+	stat, err := os.Stat(r.dir + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("site %s is not a directory", name)
+	}
+
+	baseConfig := &SiteBaseConfig{
+		Name:     name,
+		registry: r,
+	}
+
+	err = baseConfig.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	r.baseLock.Lock()
+	r.baseConfigs[name] = baseConfig
+	r.baseLock.Unlock()
+
+	return baseConfig, nil
+}
+
+func (r *Registry) LoadAllSites() error {
+	for _, baseConfig := range r.getAllBaseConfigs() {
+		baseConfig.Cleanup()
+	}
+
+	dir, err := os.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0, len(dir))
+
+	for _, entry := range dir {
+		if !entry.IsDir() {
+			continue
+		}
+
+		_, err := r.loadSite(entry.Name())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error loading site %s: %w", entry.Name(), err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for _, baseConfig := range r.getAllBaseConfigs() {
+		logrus.WithFields(baseConfig.LogrusFields()).Info("Loaded site")
+	}
+
+	for _, website := range r.GetAllSiteConfigs() {
+		logrus.WithFields(website.LogrusFields()).Info("Loaded website")
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package siteconfig
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+	"website_proxier/duration"
+)
+
+type ErrorClass string
+
+const (
+	ErrorClassTimeout           ErrorClass = "timeout"
+	ErrorClassConnectionRefused ErrorClass = "connection_refused"
+	ErrorClassConnectionReset   ErrorClass = "connection_reset"
+	ErrorClassDNS               ErrorClass = "dns"
+	ErrorClassProxy             ErrorClass = "proxy"
+	ErrorClassTLS               ErrorClass = "tls"
+	ErrorClassOther             ErrorClass = "other"
+)
+
+var errorClasses = []ErrorClass{
+	ErrorClassTimeout,
+	ErrorClassConnectionRefused,
+	ErrorClassConnectionReset,
+	ErrorClassDNS,
+	ErrorClassProxy,
+	ErrorClassTLS,
+	ErrorClassOther,
+}
+
+type RetryPolicy struct {
+	MaxAttempts   int               `json:"max_attempts"` // including the first one
+	RetryOnStatus []int             `json:"retry_on_status"`
+	RetryOnErrors []ErrorClass      `json:"retry_on_errors"`
+	BaseDelay     duration.Duration `json:"base_delay"` // doubled on every retry
+	MaxDelay      duration.Duration `json:"max_delay"`
+	Budget        duration.Duration `json:"budget"`  // no retry is started once it is spent
+	Methods       []string          `json:"methods"` // only these methods are retried
+}
+
+func (p *RetryPolicy) setDefaults() {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 4
+	}
+	if p.RetryOnStatus == nil {
+		p.RetryOnStatus = []int{http.StatusServiceUnavailable}
+	}
+	if p.RetryOnErrors == nil {
+		p.RetryOnErrors = []ErrorClass{ErrorClassTimeout, ErrorClassConnectionRefused, ErrorClassConnectionReset, ErrorClassProxy}
+	}
+	p.BaseDelay.Duration = p.BaseDelay.Or(time.Millisecond * 100)
+	p.MaxDelay.Duration = p.MaxDelay.Or(time.Second * 2)
+	p.Budget.Duration = p.Budget.Or(time.Second * 30)
+	if p.Methods == nil {
+		p.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete}
+	}
+}
+
+func (p *RetryPolicy) validate() error {
+	for _, class := range p.RetryOnErrors {
+		if !slices.Contains(errorClasses, class) {
+			return fmt.Errorf("unknown error class: %s", class)
+		}
+	}
+	return nil
+}
+
+func (p *RetryPolicy) AllowsMethod(method string) bool {
+	return slices.Contains(p.Methods, method)
+}
+
+// Attempts returns the attempts a request with method gets, a method that may
+// not be retried gets one.
+func (p *RetryPolicy) Attempts(method string) int {
+	if !p.AllowsMethod(method) {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// NextRetry returns the delay before the attempt after attempts ones. It
+// returns false when maxAttempts are used up or the attempt would start after
+// deadline, the end of the budget.
+func (p *RetryPolicy) NextRetry(attempts, maxAttempts int, deadline time.Time) (time.Duration, bool) {
+	if attempts >= maxAttempts {
+		return 0, false
+	}
+	delay := p.Backoff(attempts)
+	if time.Now().Add(delay).After(deadline) {
+		return 0, false
+	}
+	return delay, true
+}
+
+func (p *RetryPolicy) RetriesStatus(status int) bool {
+	return slices.Contains(p.RetryOnStatus, status)
+}
+
+func (p *RetryPolicy) RetriesError(class ErrorClass) bool {
+	return slices.Contains(p.RetryOnErrors, class)
+}
+
+// Backoff returns the delay before the given retry, starting at 1. It grows
+// exponentially up to MaxDelay, with jitter over its upper half.
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	delay := p.BaseDelay.Duration << (retry - 1)
+	if delay <= 0 || delay > p.MaxDelay.Duration {
+		delay = p.MaxDelay.Duration
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
@@ -0,0 +1,121 @@
+package siteconfig
+
+import (
+	"net/http"
+	"testing"
+	"time"
+	"website_proxier/duration"
+)
+
+func TestRetryMethods(t *testing.T) {
+	var policy RetryPolicy
+	policy.setDefaults()
+	custom := RetryPolicy{Methods: []string{http.MethodGet, http.MethodPost}}
+	custom.setDefaults()
+
+	tests := []struct {
+		policy *RetryPolicy
+		method string
+		want   int
+	}{
+		{&policy, http.MethodGet, 4},
+		{&policy, http.MethodPut, 4},
+		{&policy, http.MethodPost, 1},
+		{&policy, http.MethodPatch, 1},
+		{&custom, http.MethodPost, 4},
+		{&custom, http.MethodPut, 1},
+	}
+	for _, test := range tests {
+		if got := test.policy.Attempts(test.method); got != test.want {
+			t.Errorf("%s with methods %v: got %d attempts, want %d", test.method, test.policy.Methods, got, test.want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		BaseDelay: duration.Duration{Duration: time.Millisecond * 100},
+		MaxDelay:  duration.Duration{Duration: time.Second},
+	}
+	policy.setDefaults()
+
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, time.Millisecond * 100},
+		{2, time.Millisecond * 200},
+		{3, time.Millisecond * 400},
+		{4, time.Millisecond * 800},
+		{5, time.Second},
+		{60, time.Second}, // shifted past the width of a duration
+	}
+	for _, test := range tests {
+		for range 20 {
+			// jittered over the upper half
+			if got := policy.Backoff(test.retry); got < test.max/2 || got > test.max {
+				t.Errorf("retry %d: got %v, want %v to %v", test.retry, got, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	policy := RetryPolicy{
+		BaseDelay: duration.Duration{Duration: time.Millisecond * 100},
+		MaxDelay:  duration.Duration{Duration: time.Millisecond * 100},
+	}
+	policy.setDefaults()
+
+	tests := []struct {
+		name     string
+		attempts int
+		max      int
+		deadline time.Duration
+		want     bool
+	}{
+		{"attempts left", 1, 4, time.Second, true},
+		{"attempts used up", 4, 4, time.Second, false},
+		{"method not retried", 1, 1, time.Second, false},
+		{"budget spent", 1, 4, 0, false},
+		{"budget ends before the delay", 1, 4, time.Millisecond * 10, false},
+	}
+	for _, test := range tests {
+		delay, ok := policy.NextRetry(test.attempts, test.max, time.Now().Add(test.deadline))
+		if ok != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, ok, test.want)
+		}
+		if ok && (delay <= 0 || delay > policy.MaxDelay.Duration) {
+			t.Errorf("%s: delay %v out of range", test.name, delay)
+		}
+	}
+}
+
+func TestRetryStatusAndErrors(t *testing.T) {
+	var policy RetryPolicy
+	policy.setDefaults()
+
+	for status, want := range map[int]bool{503: true, 500: false, 502: false, 429: false, 200: false} {
+		if got := policy.RetriesStatus(status); got != want {
+			t.Errorf("status %d: got %v, want %v", status, got, want)
+		}
+	}
+	for class, want := range map[ErrorClass]bool{
+		ErrorClassTimeout:           true,
+		ErrorClassConnectionRefused: true,
+		ErrorClassConnectionReset:   true,
+		ErrorClassProxy:             true,
+		ErrorClassDNS:               false,
+		ErrorClassTLS:               false,
+		ErrorClassOther:             false,
+	} {
+		if got := policy.RetriesError(class); got != want {
+			t.Errorf("%s: got %v, want %v", class, got, want)
+		}
+	}
+
+	invalid := RetryPolicy{RetryOnErrors: []ErrorClass{"bogus"}}
+	if err := invalid.validate(); err == nil {
+		t.Error("expected an unknown error class to be rejected")
+	}
+}
@@ -2,36 +2,34 @@ package siteconfig
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"maps"
+	"mime"
 	"os"
+	pathpkg "path"
 	"slices"
+	"strings"
 	"sync"
 	"time"
-)
-
-const configDir = "configs_v2"
-
-var (
-	websites    = make(map[string]*WebsiteConfig)
-	websiteLock sync.RWMutex
-	baseConfigs = make(map[string]*SiteBaseConfig)
-	baseLock    sync.RWMutex
+	"website_proxier/duration"
+	"website_proxier/ipfilter"
+	"website_proxier/proxy_pool"
 )
 
 type SiteBaseConfig struct {
-	Name string
+	Name     string
+	registry *Registry
 
 	Vars           map[string]string         `json:"vars"`
 	Websites       map[string]string         `json:"websites"`        // original website domain -> new website domain
 	WebsiteConfigs map[string]*WebsiteConfig `json:"website_configs"` // new website domain -> website config
 	Deactivated    bool                      `json:"deactivated"`
+	Unavailable    *HostResponse             `json:"unavailable"` // while deactivated, the server wide response when unset
 }
 
 func (s *SiteBaseConfig) Load() error {
-	baseConfigFile, err := os.Open(configDir + "/" + s.Name + "/config.json")
+	baseConfigFile, err := os.Open(s.registry.dir + "/" + s.Name + "/config.json")
 	if err != nil {
 		return err
 	}
@@ -46,9 +44,20 @@ func (s *SiteBaseConfig) Load() error {
 	previousWebsiteConfigs := make(map[string]*WebsiteConfig, len(s.WebsiteConfigs))
 
 	maps.Copy(previousWebsiteConfigs, s.WebsiteConfigs)
+	previousPatterns := s.registry.patternsOf(s)
+	var patterns []*hostPattern
+
+	if temp.Unavailable != nil {
+		err = temp.Unavailable.Prepare(s.registry.dir + "/" + s.Name)
+		if err != nil {
+			return fmt.Errorf("error in unavailable response: %w", err)
+		}
+	}
 
 	s.Vars = temp.Vars
 	s.Websites = temp.Websites
+	s.Deactivated = temp.Deactivated
+	s.Unavailable = temp.Unavailable
 	s.WebsiteConfigs = make(map[string]*WebsiteConfig, len(s.Websites))
 
 	// apply vars to websites, as they most likely contain vars
@@ -60,32 +69,24 @@ func (s *SiteBaseConfig) Load() error {
 	}
 
 	for k, v := range s.Websites {
-		configFile, err := os.Open(configDir + "/" + s.Name + "/" + k + ".json")
+		data, err := os.ReadFile(s.registry.dir + "/" + s.Name + "/" + k + ".json")
 		if err != nil {
 			return fmt.Errorf("error opening website config file %s: %w", k, err)
 		}
 
-		websiteConfig := &WebsiteConfig{
-			TargetHost: k,
-			BaseConfig: s,
-		}
-		err = json.NewDecoder(configFile).Decode(websiteConfig)
-		_ = configFile.Close()
-		if err != nil {
-			return fmt.Errorf("error decoding website config file %s: %w", k, err)
-		}
-		websiteConfig.init()
-
-		// apply vars to replacements
-		for i := range websiteConfig.Replacements {
-			websiteConfig.Replacements[i].From, err = formatString(websiteConfig.Replacements[i].From, s.Vars)
+		if isHostPattern(k, v) {
+			pattern, err := s.newHostPattern(k, v, data)
 			if err != nil {
-				return fmt.Errorf("error formatting replacement From %s: %w", websiteConfig.Replacements[i].From, err)
-			}
-			websiteConfig.Replacements[i].To, err = formatString(websiteConfig.Replacements[i].To, s.Vars)
-			if err != nil {
-				return fmt.Errorf("error formatting replacement To %s: %w", websiteConfig.Replacements[i].To, err)
+				return err
 			}
+			pattern.carryOver(previousPatterns[k])
+			patterns = append(patterns, pattern)
+			continue
+		}
+
+		websiteConfig, err := s.newWebsiteConfig(k, v, data, s.Vars, nil)
+		if err != nil {
+			return err
 		}
 
 		if previousWebsiteConfig, ok := previousWebsiteConfigs[v]; ok {
@@ -95,32 +96,122 @@ func (s *SiteBaseConfig) Load() error {
 		s.WebsiteConfigs[v] = websiteConfig
 	}
 
-	websiteLock.Lock()
+	s.registry.websiteLock.Lock()
 
 	// remove all previous website configs
 	for k := range previousWebsiteConfigs {
-		delete(websites, k)
+		delete(s.registry.websites, k)
 	}
 
 	// add new website configs
-	for _, v := range s.Websites {
-		websites[v] = s.WebsiteConfigs[v]
+	for _, website := range s.WebsiteConfigs {
+		s.registry.websites[website.MirrorHost()] = website
 	}
-	websiteLock.Unlock()
+	s.registry.setPatterns(s, patterns)
+	s.registry.websiteLock.Unlock()
 
 	return nil
 }
 
+// newWebsiteConfig builds the website mirroring target on mirror from its JSON
+// config, vars are applied to the replacements and error pages. A website
+// resolved from a host pattern shares the rate limiter and IP filter of the
+// pattern, and its error pages with the files already read.
+func (s *SiteBaseConfig) newWebsiteConfig(target, mirror string, data []byte, vars map[string]string, shared *WebsiteConfig) (*WebsiteConfig, error) {
+	websiteConfig := &WebsiteConfig{
+		TargetHost: target,
+		BaseConfig: s,
+		mirrorHost: mirror,
+		cacheTtl:   s.registry.cacheTtl,
+	}
+	err := json.Unmarshal(data, websiteConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding website config file %s: %w", target, err)
+	}
+	websiteConfig.init()
+
+	if sticky := websiteConfig.StickySession; sticky != nil && sticky.By != StickyByIP && sticky.By != StickyByCookie {
+		return nil, fmt.Errorf("unknown sticky session key %s in %s", sticky.By, target)
+	}
+
+	err = websiteConfig.Retry.validate()
+	if err != nil {
+		return nil, fmt.Errorf("error in retry policy of %s: %w", target, err)
+	}
+
+	if websiteConfig.RateLimit != nil {
+		err = websiteConfig.RateLimit.validate()
+		if err != nil {
+			return nil, fmt.Errorf("error in rate limit of %s: %w", target, err)
+		}
+	}
+
+	if websiteConfig.Auth != nil {
+		err = websiteConfig.Auth.validate()
+		if err != nil {
+			return nil, fmt.Errorf("error in auth of %s: %w", target, err)
+		}
+		if len(websiteConfig.Auth.secret) == 0 {
+			websiteConfig.Auth.secret = s.registry.sessionKey(s.Name, mirror)
+		}
+	}
+
+	if shared != nil {
+		websiteConfig.rateLimiter = shared.rateLimiter
+		websiteConfig.ipFilter = shared.ipFilter
+		websiteConfig.ErrorPages = shared.ErrorPages
+	} else if websiteConfig.IPFilter != nil {
+		websiteConfig.ipFilter, err = ipfilter.New(*websiteConfig.IPFilter, s.registry.dir+"/"+s.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error in IP filter of %s: %w", target, err)
+		}
+	}
+
+	if websiteConfig.ErrorPages != nil {
+		websiteConfig.errorTemplates, err = websiteConfig.ErrorPages.compile(s.registry.dir+"/"+s.Name, vars)
+		if err != nil {
+			return nil, fmt.Errorf("error in error pages of %s: %w", target, err)
+		}
+	}
+
+	websiteConfig.UpstreamProtocol, err = proxy_pool.ParseProtocol(string(websiteConfig.UpstreamProtocol))
+	if err != nil {
+		return nil, fmt.Errorf("error in %s: %w", target, err)
+	}
+
+	for i := range websiteConfig.ProxyRules {
+		err = websiteConfig.ProxyRules[i].compile()
+		if err != nil {
+			return nil, fmt.Errorf("error compiling proxy rule %s: %w", websiteConfig.ProxyRules[i].Path, err)
+		}
+	}
+
+	// apply vars to replacements
+	for i := range websiteConfig.Replacements {
+		websiteConfig.Replacements[i].From, err = formatString(websiteConfig.Replacements[i].From, vars)
+		if err != nil {
+			return nil, fmt.Errorf("error formatting replacement From %s: %w", websiteConfig.Replacements[i].From, err)
+		}
+		websiteConfig.Replacements[i].To, err = formatString(websiteConfig.Replacements[i].To, vars)
+		if err != nil {
+			return nil, fmt.Errorf("error formatting replacement To %s: %w", websiteConfig.Replacements[i].To, err)
+		}
+	}
+
+	return websiteConfig, nil
+}
+
 func (s *SiteBaseConfig) Cleanup() {
-	websiteLock.Lock()
+	s.registry.websiteLock.Lock()
 	for _, v := range s.Websites {
-		delete(websites, v)
+		delete(s.registry.websites, v)
 	}
-	websiteLock.Unlock()
+	s.registry.setPatterns(s, nil)
+	s.registry.websiteLock.Unlock()
 
-	baseLock.Lock()
-	delete(baseConfigs, s.Name)
-	baseLock.Unlock()
+	s.registry.baseLock.Lock()
+	delete(s.registry.baseConfigs, s.Name)
+	s.registry.baseLock.Unlock()
 }
 
 func (s *SiteBaseConfig) LogrusFields() logrus.Fields {
@@ -129,28 +220,88 @@ func (s *SiteBaseConfig) LogrusFields() logrus.Fields {
 	}
 }
 
+type StickyBy string
+
+const (
+	StickyByIP     StickyBy = "ip"
+	StickyByCookie StickyBy = "cookie"
+)
+
+// StickySession keeps a client on the same proxy, identified either by its IP
+// or by a cookie the proxy issues.
+type StickySession struct {
+	By         StickyBy          `json:"by"`
+	TTL        duration.Duration `json:"ttl"` // sliding, renewed on every request
+	CookieName string            `json:"cookie_name"`
+}
+
+func (s *StickySession) setDefaults() {
+	if s.By == "" {
+		s.By = StickyByIP
+	}
+	s.TTL.Duration = s.TTL.Or(time.Minute * 30)
+	if s.CookieName == "" {
+		s.CookieName = "__wp_session"
+	}
+}
+
 type WebsiteConfig struct {
-	TargetHost string // set from SiteBaseConfig.Websites
-	BaseConfig *SiteBaseConfig
+	TargetHost  string // set from SiteBaseConfig.Websites
+	BaseConfig  *SiteBaseConfig
+	mirrorHost  string
+	metricsHost string // the host pattern of websites resolved from one
 
 	LoadedAt time.Time
 	cache    map[string]*PageCacheEntry
 	cacheMu  sync.Mutex
-
-	NoCache             bool              `json:"no_cache"`
-	ReqHeadersOverride  map[string]string `json:"req_headers_override"`
-	RespHeadersOverride map[string]string `json:"resp_headers_override"`
-	Replacements        []Replacement     `json:"replacements"`
-	BypassCacheFor      []string          `json:"bypass_cache_for"`
-	Block               []string          `json:"block"`
+	cacheTtl time.Duration
+
+	NoCache             bool                  `json:"no_cache"`
+	ReqHeadersOverride  map[string]string     `json:"req_headers_override"`
+	RespHeadersOverride map[string]string     `json:"resp_headers_override"`
+	Replacements        []Replacement         `json:"replacements"`
+	BypassCacheFor      []string              `json:"bypass_cache_for"`
+	Block               []string              `json:"block"`
+	ProxyGroup          string                `json:"proxy_group"` // default proxy group when empty
+	ProxyRules          []ProxyRule           `json:"proxy_rules"` // first matching rule wins
+	StickySession       *StickySession        `json:"sticky_session"`
+	Retry               RetryPolicy           `json:"retry"`
+	CircuitBreaker      *CircuitBreakerConfig `json:"circuit_breaker"`
+	ForwardRequestId    bool                  `json:"forward_request_id"` // send the X-Request-ID upstream
+	UpstreamProtocol    proxy_pool.Protocol   `json:"upstream_protocol"`  // auto, http1 or http2, auto when empty
+	Upgrade             *UpgradeConfig        `json:"upgrade"`
+	StreamContentTypes  []string              `json:"stream_content_types"` // flushed as they arrive, text/event-stream when unset
+	RateLimit           *RateLimitConfig      `json:"rate_limit"`
+	IPFilter            *ipfilter.Config      `json:"ip_filter"` // list files relative to the site config directory
+	Auth                *AuthConfig           `json:"auth"`
+	ErrorPages          *ErrorPagesConfig     `json:"error_pages"`
+
+	breaker        *CircuitBreaker
+	rateLimiter    *RateLimiter
+	ipFilter       *ipfilter.Filter
+	errorTemplates map[Failure]errorTemplate
 }
 
 func (w *WebsiteConfig) LogrusFields() logrus.Fields {
 	return logrus.Fields{
 		"name":        w.BaseConfig.Name,
 		"target_host": w.TargetHost,
-		"http_host":   w.BaseConfig.Websites[w.TargetHost],
+		"http_host":   w.MirrorHost(),
+	}
+}
+
+// MirrorHost returns the host the website is served on.
+func (w *WebsiteConfig) MirrorHost() string {
+	return w.mirrorHost
+}
+
+// MetricsHost returns the host to label metrics with, the host pattern for a
+// website resolved from one so any Host header doesn't make a new series.
+func (w *WebsiteConfig) MetricsHost() string {
+	if w.metricsHost != "" {
+		return w.metricsHost
 	}
+	return w.mirrorHost
 }
 
 func (w *WebsiteConfig) LogrusFieldsWithAction(action string) logrus.Fields {
@@ -177,9 +328,31 @@ func (w *WebsiteConfig) init() {
 	if w.Block == nil {
 		w.Block = make([]string, 0)
 	}
+	if w.StreamContentTypes == nil {
+		w.StreamContentTypes = []string{"text/event-stream"}
+	}
+	for i, contentType := range w.StreamContentTypes {
+		w.StreamContentTypes[i] = strings.ToLower(contentType)
+	}
+	if w.StickySession != nil {
+		w.StickySession.setDefaults()
+	}
+	w.Retry.setDefaults()
+	if w.Upgrade != nil {
+		w.Upgrade.setDefaults()
+	}
+	if w.CircuitBreaker != nil {
+		w.breaker = newCircuitBreaker(*w.CircuitBreaker, w)
+	}
+	if w.RateLimit != nil {
+		w.rateLimiter = newRateLimiter(*w.RateLimit)
+	}
+	if w.Auth != nil {
+		w.Auth.setDefaults()
+	}
 }
 
-func (w *WebsiteConfig) ProbeCache(path string) (*PageCacheEntry, bool) {
+func (w *WebsiteConfig) ProbeCache(path string, logr *logrus.Entry) (*PageCacheEntry, bool) {
 	if w.NoCache {
 		return nil, false
 	}
@@ -188,21 +361,47 @@ func (w *WebsiteConfig) ProbeCache(path string) (*PageCacheEntry, bool) {
 
 	entry, ok := w.cache[path]
 	if ok {
-		if time.Since(entry.FetchedAt) > cacheTtl {
+		if time.Since(entry.FetchedAt) > w.cacheTtl {
 			ok = false
 		}
 	}
 	if ok {
-		logrus.WithFields(w.LogrusFieldsWithAction("probe_cache")).WithField("path", path).Info("Returned from cache")
+		logr.WithFields(w.LogrusFieldsWithAction("probe_cache")).Info("Returned from cache")
 	}
 	return entry, ok
 }
 
+// ProbeStaleCache returns the cached entry for path even when it has expired.
+func (w *WebsiteConfig) ProbeStaleCache(path string) (*PageCacheEntry, bool) {
+	if w.NoCache {
+		return nil, false
+	}
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+
+	entry, ok := w.cache[path]
+	return entry, ok
+}
+
+// Breaker returns the circuit breaker of the upstream, nil when disabled.
+func (w *WebsiteConfig) Breaker() *CircuitBreaker {
+	return w.breaker
+}
+
+func (w *WebsiteConfig) RateLimiter() *RateLimiter {
+	return w.rateLimiter
+}
+
+// Filter returns the IP filter of the website, nil when it has none.
+func (w *WebsiteConfig) Filter() *ipfilter.Filter {
+	return w.ipFilter
+}
+
 func (w *WebsiteConfig) ShouldBlock(path string) bool {
 	return slices.Contains(w.Block, path)
 }
 
-func (w *WebsiteConfig) MbSaveToCache(path string, content []byte, headers map[string]string, status int) {
+func (w *WebsiteConfig) MbSaveToCache(path string, content []byte, headers map[string]string, status int, logr *logrus.Entry) {
 	if w.NoCache {
 		return
 	}
@@ -230,7 +429,7 @@ func (w *WebsiteConfig) MbSaveToCache(path string, content []byte, headers map[s
 		Status:    status,
 	}
 
-	logrus.WithFields(w.LogrusFieldsWithAction("save_to_cache")).WithField("path", path).Info("Saved to cache")
+	logr.WithFields(w.LogrusFieldsWithAction("save_to_cache")).Info("Saved to cache")
 }
 
 func (w *WebsiteConfig) Replace(content []byte) []byte {
@@ -240,92 +439,44 @@ func (w *WebsiteConfig) Replace(content []byte) []byte {
 	return content
 }
 
-func (w *WebsiteConfig) URL(path string) string {
-	return "https://" + w.TargetHost + path
-}
-
-func GetSiteConfig(host string) (*WebsiteConfig, bool) {
-	websiteLock.RLock()
-	defer websiteLock.RUnlock()
-
-	config, ok := websites[host]
-	return config, ok
-}
-
-func GetBaseConfigByName(name string) (*SiteBaseConfig, bool) {
-	baseLock.RLock()
-	defer baseLock.RUnlock()
-
-	config, ok := baseConfigs[name]
-	return config, ok
-}
-
-func loadSite(name string) (*SiteBaseConfig, error) {
-	stat, err := os.Stat(configDir + "/" + name)
-	if err != nil {
-		return nil, err
-	}
-	if !stat.IsDir() {
-		return nil, fmt.Errorf("site %s is not a directory", name)
-	}
-
-	baseConfig := &SiteBaseConfig{
-		Name: name,
-	}
-
-	err = baseConfig.Load()
-	if err != nil {
-		return nil, err
+// ProxyGroupFor returns the proxy group requests for path should go through.
+func (w *WebsiteConfig) ProxyGroupFor(path string) string {
+	for i := range w.ProxyRules {
+		if w.ProxyRules[i].Matches(path) {
+			return w.ProxyRules[i].Group
+		}
 	}
-
-	baseLock.Lock()
-	baseConfigs[name] = baseConfig
-	baseLock.Unlock()
-
-	return baseConfig, nil
+	return w.ProxyGroup
 }
 
-func LoadAllSites() error {
-	for _, baseConfig := range baseConfigs {
-		baseConfig.Cleanup()
-	}
-
-	dir, err := os.ReadDir(configDir)
+// IsStream reports whether responses of contentType are streamed to the
+// client instead of buffered.
+func (w *WebsiteConfig) IsStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return err
-	}
-
-	errs := make([]error, 0, len(dir))
-
-	for _, entry := range dir {
-		if !entry.IsDir() {
-			continue
-		}
-
-		_, err := loadSite(entry.Name())
-		if err != nil {
-			errs = append(errs, fmt.Errorf("error loading site %s: %w", entry.Name(), err))
-		}
+		return false
 	}
+	return slices.Contains(w.StreamContentTypes, mediaType)
+}
 
-	if len(errs) > 0 {
-		return errors.Join(errs...)
-	}
+func (w *WebsiteConfig) URL(path string) string {
+	return "https://" + w.TargetHost + path
+}
 
-	for _, baseConfig := range baseConfigs {
-		logrus.WithFields(baseConfig.LogrusFields()).Info("Loaded site")
+// CleanPath resolves . and .. segments and duplicate slashes of a request
+// path, keeping a trailing slash. Path rules are matched on the clean path and
+// it is what the upstream gets, so "/static/../admin" can't pass for a static
+// file.
+func CleanPath(path string) string {
+	if path == "" {
+		return "/"
 	}
-
-	for _, website := range websites {
-		logrus.WithFields(website.LogrusFields()).Info("Loaded website")
+	if path[0] != '/' {
+		path = "/" + path
 	}
-
-	return nil
-}
-
-func init() {
-	err := LoadAllSites()
-	if err != nil {
-		panic(err)
+	cleaned := pathpkg.Clean(path)
+	if strings.HasSuffix(path, "/") && cleaned != "/" {
+		cleaned += "/"
 	}
+	return cleaned
 }
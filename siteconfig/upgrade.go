@@ -0,0 +1,33 @@
+package siteconfig
+
+import (
+	"slices"
+	"strings"
+	"time"
+	"website_proxier/duration"
+)
+
+// UpgradeConfig lets upgraded connections (WebSockets) through to the
+// upstream. Without it upgrade requests are proxied like any other request.
+type UpgradeConfig struct {
+	Protocols   []string          `json:"protocols"`    // Upgrade header values let through, websocket when empty
+	IdleTimeout duration.Duration `json:"idle_timeout"` // close when no data moved in either direction
+}
+
+func (c *UpgradeConfig) setDefaults() {
+	if len(c.Protocols) == 0 {
+		c.Protocols = []string{"websocket"}
+	}
+	c.IdleTimeout.Duration = c.IdleTimeout.Or(time.Minute * 2)
+}
+
+// Allows reports whether connections may be upgraded to protocol, a nil config
+// allows none.
+func (c *UpgradeConfig) Allows(protocol string) bool {
+	if c == nil {
+		return false
+	}
+	return slices.ContainsFunc(c.Protocols, func(p string) bool {
+		return strings.EqualFold(p, protocol)
+	})
+}